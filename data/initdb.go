@@ -27,6 +27,46 @@ func main() {
 		if err != nil {
 			return fmt.Errorf("cannot create bucket: %s", err)
 		}
+		_, err = tx.CreateBucket([]byte("reaps"))
+		if err != nil {
+			return fmt.Errorf("cannot create bucket: %s", err)
+		}
+		_, err = tx.CreateBucket([]byte("unreaps"))
+		if err != nil {
+			return fmt.Errorf("cannot create bucket: %s", err)
+		}
+		_, err = tx.CreateBucket([]byte("scrubs"))
+		if err != nil {
+			return fmt.Errorf("cannot create bucket: %s", err)
+		}
+		_, err = tx.CreateBucket([]byte("dedups"))
+		if err != nil {
+			return fmt.Errorf("cannot create bucket: %s", err)
+		}
+		_, err = tx.CreateBucket([]byte("chunks"))
+		if err != nil {
+			return fmt.Errorf("cannot create bucket: %s", err)
+		}
+		_, err = tx.CreateBucket([]byte("uploads"))
+		if err != nil {
+			return fmt.Errorf("cannot create bucket: %s", err)
+		}
+		_, err = tx.CreateBucket([]byte("dirs"))
+		if err != nil {
+			return fmt.Errorf("cannot create bucket: %s", err)
+		}
+		_, err = tx.CreateBucket([]byte("tags"))
+		if err != nil {
+			return fmt.Errorf("cannot create bucket: %s", err)
+		}
+		_, err = tx.CreateBucket([]byte("versions"))
+		if err != nil {
+			return fmt.Errorf("cannot create bucket: %s", err)
+		}
+		_, err = tx.CreateBucket([]byte("trash"))
+		if err != nil {
+			return fmt.Errorf("cannot create bucket: %s", err)
+		}
 		return nil
 	})
 }
@@ -0,0 +1,118 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+// Package cdc implements content defined chunking using FastCDC.
+//
+// A cut point is placed where the gear hash of the recent bytes matches
+// a mask, thus an insertion or deletion in a stream only changes the
+// chunks around it, and the other chunks stay the same.
+package cdc
+
+import (
+	"errors"
+	"io"
+)
+
+// The sizes of the chunks are bound by MinSize and MaxSize, and most of
+// them are close to AvgSize.
+const (
+	MinSize = 512 << 10
+	AvgSize = 2 << 20
+	MaxSize = 8 << 20
+)
+
+// The masks normalize the chunk sizes around AvgSize: it is harder to
+// cut before AvgSize and easier after it. The gear hash is shifted to
+// the left, hence the upper bits depend on more bytes than the lower
+// ones.
+const (
+	maskS = uint64(1<<23-1) << (64 - 23)
+	maskL = uint64(1<<19-1) << (64 - 19)
+)
+
+var gear [256]uint64
+
+func init() {
+	// splitmix64 with a fixed seed, the table must never change,
+	// otherwise the chunks of the same content differ.
+	x := uint64(0x766f6964) // "void"
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// Chunker splits a stream into content defined chunks.
+type Chunker struct {
+	r   io.Reader
+	buf []byte
+	n   int // number of buffered bytes
+	off int // start of the buffered bytes that are not returned yet
+	eof bool
+}
+
+// New returns a chunker that reads from r.
+func New(r io.Reader) *Chunker {
+	return &Chunker{r: r, buf: make([]byte, 2*MaxSize)}
+}
+
+// Next returns the next chunk. The returned slice is only valid until
+// the next call. It returns io.EOF if there are no more chunks.
+func (c *Chunker) Next() ([]byte, error) {
+	if c.n-c.off < MaxSize && !c.eof {
+		copy(c.buf, c.buf[c.off:c.n])
+		c.n -= c.off
+		c.off = 0
+
+		m, err := io.ReadFull(c.r, c.buf[c.n:])
+		c.n += m
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.off == c.n {
+		return nil, io.EOF
+	}
+
+	data := c.buf[c.off:c.n]
+	cut := cutPoint(data)
+	c.off += cut
+	return data[:cut], nil
+}
+
+// cutPoint returns the length of the first chunk of the data.
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= MinSize {
+		return n
+	}
+	if n > MaxSize {
+		n = MaxSize
+	}
+	normal := AvgSize
+	if n < normal {
+		normal = n
+	}
+
+	var h uint64
+	i := MinSize
+	for ; i < normal; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
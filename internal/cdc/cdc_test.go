@@ -0,0 +1,86 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package cdc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// chunks returns the checksums of the chunks of the given data, and
+// checks that the chunks are bound by the sizes and make up the data.
+func chunks(t *testing.T, data []byte) [][32]byte {
+	t.Helper()
+
+	var (
+		sums [][32]byte
+		all  []byte
+	)
+	c := New(bytes.NewReader(data))
+	for {
+		chunk, err := c.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		if len(chunk) > MaxSize || (len(chunk) < MinSize && len(all)+len(chunk) != len(data)) {
+			t.Fatalf("chunk %d has %d bytes", len(sums), len(chunk))
+		}
+		all = append(all, chunk...)
+		sums = append(sums, sha256.Sum256(chunk))
+	}
+	if !bytes.Equal(all, data) {
+		t.Fatalf("chunks do not make up the data")
+	}
+	return sums
+}
+
+func TestChunkBoundaries(t *testing.T) {
+	data := make([]byte, 32<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	orig := chunks(t, data)
+	if len(orig) < 4 {
+		t.Fatalf("data has only %d chunks", len(orig))
+	}
+
+	tests := []struct {
+		name   string
+		at     int
+		insert []byte
+		remove int
+	}{
+		{"insert byte at start", 0, []byte{42}, 0},
+		{"insert byte in the middle", 13 << 20, []byte{42}, 0},
+		{"insert block in the middle", 13 << 20, bytes.Repeat([]byte("void"), 1000), 0},
+		{"remove bytes in the middle", 13 << 20, nil, 4096},
+		{"append bytes", len(data), []byte("void"), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			edited := append(append(append([]byte(nil), data[:tt.at]...), tt.insert...), data[tt.at+tt.remove:]...)
+			got := chunks(t, edited)
+
+			// Only the chunks around the edit change.
+			seen := map[[32]byte]bool{}
+			for _, s := range got {
+				seen[s] = true
+			}
+			changed := 0
+			for _, s := range orig {
+				if !seen[s] {
+					changed++
+				}
+			}
+			if changed > 2 {
+				t.Fatalf("%d of %d chunks changed", changed, len(orig))
+			}
+		})
+	}
+}
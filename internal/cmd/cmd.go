@@ -7,18 +7,23 @@ package cmd
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
+	"changkun.de/x/void/internal/store"
 	"changkun.de/x/void/internal/void"
-	"golang.design/x/tgstore"
 )
 
 func appendQueryToken(addr, token string) string {
@@ -32,9 +37,35 @@ func appendQueryToken(addr, token string) string {
 	return ur.String()
 }
 
+// fileURL returns the address of a file that is referred to by its id,
+// or by its path in the tree of folders if the reference starts with a
+// slash.
+func fileURL(ref string, q url.Values) string {
+	addr := Endpoint
+	if strings.HasPrefix(ref, "/") {
+		addr += "/fs" + (&url.URL{Path: ref}).EscapedPath()
+	} else {
+		q.Set("id", ref)
+	}
+	return addr + "?" + q.Encode()
+}
+
+// UploadOptions are the options of an upload.
+type UploadOptions struct {
+	// E2E encrypts the file by a key that never leaves the command
+	// line.
+	E2E bool
+	// Dir is the folder of the file, or the root folder if it is empty.
+	Dir string
+	// Tags and Attrs are the tags and the key value attributes of the
+	// file.
+	Tags  []string
+	Attrs map[string]string
+}
+
 // Upload uploads the given file to the void server and returns
 // the corresponding file ID for future downloads.
-func Upload(fpath string) (r *void.Response, err error) {
+func Upload(fpath string, opts UploadOptions) (r *void.Response, err error) {
 	defer func() {
 		if err == nil {
 			return
@@ -57,8 +88,60 @@ func Upload(fpath string) (r *void.Response, err error) {
 	}
 	defer f.Close()
 
+	// content reads the file from the start. The content of a file that
+	// is encrypted end-to-end is the sealed file.
 	m := &void.Metadata{FileSize: fi.Size()}
 	_, m.FileName = filepath.Split(fpath)
+	if opts.Dir != "" {
+		m.Path = strings.TrimSuffix(opts.Dir, "/") + "/"
+	}
+	m.Tags, m.Attrs = opts.Tags, opts.Attrs
+	content := func() (io.ReadCloser, error) {
+		_, err := f.Seek(0, io.SeekStart)
+		return io.NopCloser(f), err
+	}
+	if opts.E2E {
+		var key []byte
+		key, m.E2E, err = newE2EKey()
+		if err != nil {
+			return
+		}
+		m.FileSize = store.SealedSize(m.FileSize)
+		m.E2E.Sealed, err = void.SealName(key, m.FileName)
+		if err != nil {
+			return
+		}
+		m.FileName = ""
+		content = func() (io.ReadCloser, error) {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			return sealed(f, key), nil
+		}
+	}
+
+	if void.Conf.Proxy {
+		return uploadProxy(m, content)
+	}
+
+	// The checksums of the file and of its chunks let the server skip
+	// the upload of content that was uploaded before.
+	var c io.ReadCloser
+	c, err = content()
+	if err != nil {
+		return
+	}
+	h := sha256.New()
+	if void.Conf.Chunking {
+		m.Chunks, err = void.HashChunks(io.TeeReader(c, h))
+	} else {
+		_, err = io.Copy(h, c)
+	}
+	c.Close()
+	if err != nil {
+		return
+	}
+	m.Sha256 = hex.EncodeToString(h.Sum(nil))
 	var b []byte
 	b, err = json.Marshal(m)
 	if err != nil {
@@ -66,7 +149,7 @@ func Upload(fpath string) (r *void.Response, err error) {
 	}
 
 	var req *http.Request
-	req, err = http.NewRequest(http.MethodPut, appendQueryToken(Endpoint, void.Conf.Auth), bytes.NewReader(b))
+	req, err = http.NewRequest(http.MethodPut, appendQueryToken(Endpoint+"?scope=direct", void.Conf.Auth), bytes.NewReader(b))
 	if err != nil {
 		return
 	}
@@ -81,17 +164,43 @@ func Upload(fpath string) (r *void.Response, err error) {
 	if err != nil {
 		return
 	}
+	if resp.StatusCode != http.StatusOK {
+		rr := &void.Response{}
+		_ = json.Unmarshal(b, rr)
+		err = errors.New(rr.Message)
+		return
+	}
 	meta := &void.Metadata{}
 	err = json.Unmarshal(b, meta)
 	if err != nil {
 		return
 	}
 
+	// The server already has the content, nothing needs to be uploaded.
+	if meta.UploadId != "" {
+		log.Printf("%s: same content exists, upload skipped.\n", m.FileName)
+		return &void.Response{Id: meta.Id}, nil
+	}
+
 	// Now we have the server allocated metadata, let's upload the file.
-	store := tgstore.New()
-	store.BotToken = void.Conf.BotToken
-	store.ChatID = void.Conf.ChatID
-	meta.UploadId, err = store.Upload(context.Background(), meta.Key, f)
+	c, err = content()
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	if void.Conf.Chunking {
+		known := map[string]*void.Object{}
+		for i := range meta.Chunks {
+			if meta.Chunks[i].UploadId != "" {
+				known[meta.Chunks[i].Sha256] = &meta.Chunks[i].Object
+			}
+		}
+		err = void.NewStorage().PutChunks(context.Background(), &meta.Object, c, func(sum string) *void.Object {
+			return known[sum]
+		})
+	} else {
+		err = void.NewStorage().Put(context.Background(), &meta.Object, c)
+	}
 	if err != nil {
 		err = fmt.Errorf("upload failed with error: %w", err)
 		return
@@ -104,7 +213,7 @@ func Upload(fpath string) (r *void.Response, err error) {
 		return
 	}
 
-	req, err = http.NewRequest(http.MethodPut, appendQueryToken(Endpoint, void.Conf.Auth), bytes.NewReader(b))
+	req, err = http.NewRequest(http.MethodPut, appendQueryToken(Endpoint+"?scope=direct", void.Conf.Auth), bytes.NewReader(b))
 	if err != nil {
 		return
 	}
@@ -126,14 +235,127 @@ func Upload(fpath string) (r *void.Response, err error) {
 		return
 	}
 
-	return &void.Response{Id: meta.Id}, nil
+	// The server responds the id of the file, which differs from the
+	// reserved id if the file is a new version of another file.
+	rr := &void.Response{Id: meta.Id}
+	if len(b) > 0 {
+		_ = json.Unmarshal(b, rr)
+	}
+	return rr, nil
+}
+
+// uploadProxy streams the content of the given file through the
+// server, which stores it in the backends.
+func uploadProxy(m *void.Metadata, content func() (io.ReadCloser, error)) (r *void.Response, err error) {
+	var c io.ReadCloser
+	c, err = content()
+	if err != nil {
+		return
+	}
+	defer c.Close()
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		var err error
+		if m.E2E != nil {
+			var fw io.Writer
+			fw, err = mw.CreateFormField("e2e")
+			if err == nil {
+				err = json.NewEncoder(fw).Encode(m.E2E)
+			}
+		}
+		if err == nil && len(m.Tags) > 0 {
+			err = mw.WriteField("tag", strings.Join(m.Tags, ","))
+		}
+		for k, v := range m.Attrs {
+			if err == nil {
+				err = mw.WriteField("attr", k+"="+v)
+			}
+		}
+		var fw io.Writer
+		if err == nil {
+			name := m.FileName
+			if name == "" {
+				name = void.EncryptedName
+			}
+			fw, err = mw.CreateFormFile("file", name)
+		}
+		if err == nil {
+			_, err = io.Copy(fw, c)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	addr := Endpoint
+	if m.Path != "" {
+		addr += "?dir=" + url.QueryEscape(m.Path)
+	}
+	var req *http.Request
+	req, err = http.NewRequest(http.MethodPost, appendQueryToken(addr, void.Conf.Auth), pr)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	var resp *http.Response
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	var b []byte
+	b, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+
+	r = &void.Response{}
+	_ = json.Unmarshal(b, r)
+	if resp.StatusCode != http.StatusOK {
+		err = errors.New(r.Message)
+		return nil, err
+	}
+	return r, nil
+}
+
+// openContent returns a reader of the content of the given file. The
+// content is downloaded through the server in the proxy mode, and from
+// the backends otherwise.
+func openContent(meta *void.Metadata) (io.ReadCloser, error) {
+	if !void.Conf.Proxy {
+		return void.NewStorage().Open(context.Background(), &meta.Object)
+	}
+
+	q := url.Values{"id": {meta.Id}}
+	if meta.Version > 0 {
+		q.Set("version", strconv.Itoa(meta.Version))
+	}
+	req, err := http.NewRequest(http.MethodGet, appendQueryToken(Endpoint+"?"+q.Encode(), void.Conf.Auth), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed with status: %v", resp.StatusCode)
+	}
+	return resp.Body, nil
 }
 
 const overwrite = "\r\033[1A\033[0K"
 
-// Download tries to download the corresponding file of the given id,
-// and stores it to the given destination folder.
-func Download(id string) (err error) {
+// Download tries to download the corresponding file of the given id or
+// path, and stores it to the given destination folder. A positive
+// version downloads the version of the file instead of the current one.
+func Download(id string, version int) (err error) {
 	defer func() {
 		if err == nil {
 			return
@@ -143,7 +365,15 @@ func Download(id string) (err error) {
 	}()
 
 	var req *http.Request
-	req, err = http.NewRequest(http.MethodGet, appendQueryToken(Endpoint+"?mode=data&id="+id, void.Conf.Auth), nil)
+	// Only the direct download needs the key of the file.
+	q := url.Values{"mode": {"data"}}
+	if !void.Conf.Proxy {
+		q.Set("scope", "direct")
+	}
+	if version > 0 {
+		q.Set("version", strconv.Itoa(version))
+	}
+	req, err = http.NewRequest(http.MethodGet, appendQueryToken(fileURL(id, q), void.Conf.Auth), nil)
 	if err != nil {
 		return
 	}
@@ -168,28 +398,62 @@ func Download(id string) (err error) {
 	switch resp.StatusCode {
 	case http.StatusOK:
 
-		var tgf io.ReadSeekCloser
-		store := tgstore.New()
-		store.BotToken = void.Conf.BotToken
-		store.ChatID = void.Conf.ChatID
-		tgf, err = store.Download(context.Background(), meta.Key, meta.UploadId)
+		var tgf io.ReadCloser
+		tgf, err = openContent(meta)
 		if err != nil {
 			err = fmt.Errorf("download with error: %w", err)
 			return
 		}
 		defer tgf.Close()
 
+		// The checksum is of the content as it is stored, which is
+		// decrypted here if the file is encrypted end-to-end.
+		h := sha256.New()
+		var body io.Reader = io.TeeReader(tgf, h)
+		size := meta.FileSize
+		if meta.E2E != nil {
+			var key []byte
+			key, err = e2eKey(meta.E2E)
+			if err != nil {
+				return
+			}
+			body, err = store.Unseal(body, key)
+			if err != nil {
+				return
+			}
+			size = store.PlainSize(meta.FileSize)
+			if meta.E2E.Sealed != nil {
+				meta.FileName, err = void.OpenName(key, meta.E2E.Sealed)
+				if err != nil {
+					return
+				}
+			}
+		}
+		if meta.FileName == void.EncryptedName {
+			meta.FileName = meta.Id
+		}
+
 		var f *os.File
 		f, err = os.Create(meta.FileName)
 		if err != nil {
 			return err
 		}
 		defer f.Close()
+		defer func() {
+			if err != nil {
+				os.Remove(meta.FileName)
+			}
+		}()
 
 		log.Printf("[%d] downloading: %sprogress: 0.00%%", resp.StatusCode, meta.FileName)
 		batch := int64(1 << 15)
-		for i := int64(0); i < meta.FileSize; i += batch {
-			_, err = io.CopyN(f, tgf, int64(batch))
+		// The content is read to the end, so that a longer content is
+		// detected as well as a truncated one.
+		var n int64
+		for {
+			var nn int64
+			nn, err = io.CopyN(f, body, batch)
+			n += nn
 			if err == io.EOF {
 				err = nil
 				break
@@ -197,7 +461,21 @@ func Download(id string) (err error) {
 			if err != nil {
 				return
 			}
-			log.Printf("[%d] progress: %.2f%%%s", resp.StatusCode, float64(i*100)/float64(meta.FileSize), overwrite)
+			if size > 0 {
+				log.Printf("[%d] progress: %.2f%%%s", resp.StatusCode, float64(n*100)/float64(size), overwrite)
+			}
+		}
+		if n < size {
+			err = fmt.Errorf("%s is truncated, expect %d bytes, got %d", meta.FileName, size, n)
+			return
+		}
+		if n > size {
+			err = fmt.Errorf("%s is longer than expected, expect %d bytes, got %d", meta.FileName, size, n)
+			return
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); meta.Sha256 != "" && sum != meta.Sha256 {
+			err = fmt.Errorf("%s is corrupted, expect sha256 %s, got %s", meta.FileName, meta.Sha256, sum)
+			return
 		}
 		log.Println("DONE.                    ")
 	default:
@@ -217,7 +495,8 @@ func Download(id string) (err error) {
 	return
 }
 
-// Delete deletes a given id from the current database.
+// Delete deletes a given id from the current database. A path deletes
+// the file or the empty folder at the path.
 func Delete(id string) (err error) {
 	defer func() {
 		if err == nil {
@@ -228,7 +507,7 @@ func Delete(id string) (err error) {
 	}()
 
 	var req *http.Request
-	req, err = http.NewRequest(http.MethodDelete, appendQueryToken(Endpoint+"?id="+id, void.Conf.Auth), nil)
+	req, err = http.NewRequest(http.MethodDelete, appendQueryToken(fileURL(id, url.Values{}), void.Conf.Auth), nil)
 	if err != nil {
 		return
 	}
@@ -249,8 +528,10 @@ func Delete(id string) (err error) {
 	}
 }
 
-// List lists all existing files in the current database.
-func List() (files []*void.Metadata, err error) {
+// List lists the files in the current database of the given options.
+// It lists all pages of files unless the options limit the page, in
+// which case it returns the cursor of the next page if there is one.
+func List(opts void.ListOptions) (files []*void.Metadata, next string, err error) {
 	defer func() {
 		if err == nil {
 			return
@@ -259,8 +540,160 @@ func List() (files []*void.Metadata, err error) {
 		err = fmt.Errorf("list error: %w", err)
 	}()
 
+	files = []*void.Metadata{}
+	for {
+		q := opts.Query()
+		q.Set("mode", "data")
+
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodGet, appendQueryToken(Endpoint+"?"+q.Encode(), void.Conf.Auth), nil)
+		if err != nil {
+			return
+		}
+
+		var resp *http.Response
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			return
+		}
+
+		var raw []byte
+		raw, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			r := &void.Response{}
+			_ = json.Unmarshal(raw, r)
+			err = fmt.Errorf("failed with status: %v, %s", resp.StatusCode, r.Message)
+			return
+		}
+
+		page := []*void.Metadata{}
+		err = json.Unmarshal(raw, &page)
+		if err != nil {
+			return
+		}
+		openNames(page)
+		files = append(files, page...)
+
+		next = nextCursor(resp.Header.Get("Link"))
+		if opts.Limit > 0 || next == "" {
+			return
+		}
+		opts.Cursor = next
+	}
+}
+
+// nextCursor returns the cursor of the next page in the given Link
+// header, or an empty cursor if there is no next page.
+func nextCursor(link string) string {
+	target, params, ok := strings.Cut(strings.TrimPrefix(link, "<"), ">")
+	if !ok || !strings.Contains(params, `rel="next"`) {
+		return ""
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("cursor")
+}
+
+// openNames opens the names that were sealed by the keys of this
+// machine, the others stay as placeholders.
+func openNames(files []*void.Metadata) {
+	for _, f := range files {
+		if f.E2E == nil || f.E2E.Sealed == nil {
+			continue
+		}
+		if key, e := e2eKey(f.E2E); e == nil {
+			if name, e := void.OpenName(key, f.E2E.Sealed); e == nil {
+				f.FileName = name
+			}
+		}
+	}
+}
+
+// ListFolder lists the content of the given folder, with the files that
+// are filtered and sorted by the given options. It lists all pages of
+// files unless the options limit the page, in which case the folder
+// has the cursor of the next page if there is one.
+func ListFolder(dir string, opts void.ListOptions) (folder *void.Folder, err error) {
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		err = fmt.Errorf("list error: %w", err)
+	}()
+
+	for {
+		var raw []byte
+		q := opts.Query()
+		q.Set("mode", "data")
+		raw, err = fsRequest(http.MethodGet, dir, q)
+		if err != nil {
+			return
+		}
+		page := &void.Folder{}
+		err = json.Unmarshal(raw, page)
+		if err != nil {
+			return
+		}
+		openNames(page.Files)
+		if folder == nil {
+			folder = page
+		} else {
+			folder.Files = append(folder.Files, page.Files...)
+			folder.Next = page.Next
+		}
+
+		if opts.Limit > 0 || folder.Next == "" {
+			return
+		}
+		opts.Cursor = folder.Next
+	}
+}
+
+// Mkdir creates the given folder and its missing parents.
+func Mkdir(dir string) (err error) {
+	_, err = fsRequest(http.MethodPost, dir, url.Values{"op": {"mkdir"}})
+	if err != nil {
+		err = fmt.Errorf("mkdir error: %w", err)
+	}
+	return
+}
+
+// Move moves the file or folder at the given path to the destination,
+// or into the destination if it is a folder.
+func Move(src, dst string) (err error) {
+	_, err = fsRequest(http.MethodPost, src, url.Values{"op": {"move"}, "to": {dst}})
+	if err != nil {
+		err = fmt.Errorf("move error: %w", err)
+	}
+	return
+}
+
+// Patch edits the tags and the attributes of the file of the given id
+// or path.
+func Patch(id string, p *void.Patch) (meta *void.Metadata, err error) {
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		err = fmt.Errorf("patch error: %w", err)
+	}()
+
+	var b []byte
+	b, err = json.Marshal(p)
+	if err != nil {
+		return
+	}
+
 	var req *http.Request
-	req, err = http.NewRequest(http.MethodGet, appendQueryToken(Endpoint+"?mode=data", void.Conf.Auth), nil)
+	req, err = http.NewRequest(http.MethodPatch, appendQueryToken(fileURL(id, url.Values{}), void.Conf.Auth), bytes.NewReader(b))
 	if err != nil {
 		return
 	}
@@ -271,20 +704,147 @@ func List() (files []*void.Metadata, err error) {
 		return
 	}
 	defer resp.Body.Close()
+	b, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		r := &void.Response{}
+		_ = json.Unmarshal(b, r)
+		err = fmt.Errorf("failed with status: %v, %s", resp.StatusCode, r.Message)
+		return
+	}
+	meta = &void.Metadata{}
+	err = json.Unmarshal(b, meta)
+	return
+}
+
+// Versions returns all versions of the file of the given id or path,
+// the current version first.
+func Versions(id string) (versions []*void.Metadata, err error) {
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		err = fmt.Errorf("versions error: %w", err)
+	}()
+
+	var b []byte
+	b, err = fileRequest(http.MethodGet, id, url.Values{"mode": {"versions"}})
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &versions)
+	if err != nil {
+		return
+	}
+	openNames(versions)
+	return
+}
+
+// Rollback makes the given version of the file of the given id or path
+// the current version.
+func Rollback(id string, version int) (meta *void.Metadata, err error) {
+	defer func() {
+		if err == nil {
+			return
+		}
 
-	var raw []byte
-	raw, err = io.ReadAll(resp.Body)
+		err = fmt.Errorf("rollback error: %w", err)
+	}()
+
+	var b []byte
+	b, err = fileRequest(http.MethodPost, id, url.Values{"op": {"rollback"}, "version": {strconv.Itoa(version)}})
 	if err != nil {
 		return
 	}
+	meta = &void.Metadata{}
+	err = json.Unmarshal(b, meta)
+	return
+}
 
-	switch resp.StatusCode {
-	case http.StatusOK:
-		files = []*void.Metadata{}
-		err = json.Unmarshal(raw, &files)
+// Trash returns the files in the trash, the latest deleted file first.
+func Trash() (files []*void.Metadata, err error) {
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		err = fmt.Errorf("trash error: %w", err)
+	}()
+
+	var b []byte
+	b, err = request(http.MethodGet, Endpoint+"?mode=trash")
+	if err != nil {
 		return
-	default:
-		err = fmt.Errorf("failed with status: %v", resp.StatusCode)
+	}
+	err = json.Unmarshal(b, &files)
+	if err != nil {
+		return
+	}
+	openNames(files)
+	return
+}
+
+// Restore restores the file of the given id from the trash.
+func Restore(id string) (meta *void.Metadata, err error) {
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		err = fmt.Errorf("restore error: %w", err)
+	}()
+
+	var b []byte
+	b, err = request(http.MethodPost, Endpoint+"?"+url.Values{"op": {"restore"}, "id": {id}}.Encode())
+	if err != nil {
+		return
+	}
+	meta = &void.Metadata{}
+	err = json.Unmarshal(b, meta)
+	return
+}
+
+// fsRequest sends a request of the given method to the given path in
+// the tree of folders and returns the response body.
+func fsRequest(method, p string, q url.Values) (b []byte, err error) {
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return fileRequest(method, p, q)
+}
+
+// fileRequest sends a request of the given method to the file of the
+// given id or path and returns the response body.
+func fileRequest(method, ref string, q url.Values) (b []byte, err error) {
+	return request(method, fileURL(ref, q))
+}
+
+// request sends a request of the given method to the given address and
+// returns the response body.
+func request(method, addr string) (b []byte, err error) {
+	var req *http.Request
+	req, err = http.NewRequest(method, appendQueryToken(addr, void.Conf.Auth), nil)
+	if err != nil {
+		return
+	}
+
+	var resp *http.Response
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
 		return
 	}
+	defer resp.Body.Close()
+	b, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		r := &void.Response{}
+		_ = json.Unmarshal(b, r)
+		err = fmt.Errorf("failed with status: %v, %s", resp.StatusCode, r.Message)
+	}
+	return
 }
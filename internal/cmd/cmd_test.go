@@ -0,0 +1,163 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"changkun.de/x/login"
+	"changkun.de/x/void/internal/void"
+)
+
+// setup points the command line at the given handler, and runs the
+// test in a temporary working directory. The configuration is restored
+// after the test.
+func setup(t *testing.T, h http.Handler) {
+	t.Helper()
+	conf, endpoint := void.Conf, Endpoint
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("chdir: %v", err)
+	}
+	ts := httptest.NewServer(h)
+	Endpoint = ts.URL + "/void"
+	t.Cleanup(func() {
+		ts.Close()
+		os.Chdir(wd)
+		void.Conf, Endpoint = conf, endpoint
+	})
+}
+
+// serve points the command line at a void server of a database and a
+// local backend in a temporary directory, which accepts every token as
+// the login of the given user.
+func serve(t *testing.T, user string) {
+	t.Helper()
+	verify := login.VerifyEndpoint
+	ls := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"username": user})
+	}))
+	t.Cleanup(func() {
+		ls.Close()
+		login.VerifyEndpoint = verify
+	})
+	login.VerifyEndpoint = ls.URL
+
+	conf := void.Conf
+	t.Cleanup(func() { void.Conf = conf })
+	dir := t.TempDir()
+	void.Conf.DB = filepath.Join(dir, "void.db")
+	void.Conf.Stores, void.Conf.StoreDirs = []string{"local"}, []string{filepath.Join(dir, "store")}
+	void.Conf.Auth = "token"
+	setup(t, void.NewServer().Handler())
+}
+
+func TestDownloadVerify(t *testing.T) {
+	data := bytes.Repeat([]byte("void verifies downloads "), 10000)
+	sum := sha256.Sum256(data)
+	corrupted := append([]byte(nil), data...)
+	corrupted[len(data)/2] ^= 0xff
+
+	tests := []struct {
+		name    string
+		content []byte
+		err     string
+	}{
+		{"intact", data, ""},
+		{"corrupted", corrupted, "corrupted"},
+		{"truncated", data[:len(data)-1], "truncated"},
+		{"longer", append(append([]byte(nil), data...), 0), "longer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := &void.Metadata{Id: "id", FileName: "a.txt", FileSize: int64(len(data))}
+			meta.Sha256 = hex.EncodeToString(sum[:])
+			setup(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("mode") == "data" {
+					json.NewEncoder(w).Encode(meta)
+					return
+				}
+				w.Write(tt.content)
+			}))
+			void.Conf.Proxy = true
+
+			err := Download("id", 0)
+			if (err == nil) != (tt.err == "") || err != nil && !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("download: %v, want error %q", err, tt.err)
+			}
+			got, rerr := os.ReadFile("a.txt")
+			if tt.err == "" && !bytes.Equal(got, data) {
+				t.Fatalf("download writes %d bytes: %v", len(got), rerr)
+			}
+			if tt.err != "" && !os.IsNotExist(rerr) {
+				t.Fatalf("download keeps the rejected file")
+			}
+		})
+	}
+}
+
+func TestProxyRoundTrip(t *testing.T) {
+	serve(t, "alice")
+	void.Conf.Proxy = true
+
+	data := bytes.Repeat([]byte("void streams through the server "), 10000)
+	if err := os.Mkdir("src", 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join("src", "a.txt"), data, 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	r, err := Upload(filepath.Join("src", "a.txt"), UploadOptions{})
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if err := Download(r.Id, 0); err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	got, err := os.ReadFile("a.txt")
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("download reads %d bytes of another content: %v", len(got), err)
+	}
+}
+
+func TestDirectSealed(t *testing.T) {
+	conf := void.Conf
+	t.Cleanup(func() { void.Conf = conf })
+	void.Conf.KEK = bytes.Repeat([]byte{1}, 32)
+	void.Conf.SealNames = true
+	void.Conf.MetaUsers = []string{"alice"}
+	void.Conf.DirectUsers = []string{"bob"}
+	serve(t, "bob")
+
+	// Bob may access the backends but not see the names of the files.
+	data := bytes.Repeat([]byte("void seals names "), 10000)
+	if err := os.WriteFile("secret.txt", data, 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	r, err := Upload("secret.txt", UploadOptions{})
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if err := Download(r.Id, 0); err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	got, err := os.ReadFile(r.Id)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("download reads %d bytes of another content: %v", len(got), err)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"changkun.de/x/void/internal/store"
+	"changkun.de/x/void/internal/void"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// newE2EKey returns a new key to encrypt a file before the upload. The
+// key is derived from VOID_PASSPHRASE if it is set, otherwise the key
+// is generated and kept in the local keyring.
+func newE2EKey() ([]byte, *void.E2E, error) {
+	if void.Conf.Passphrase != "" {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, nil, err
+		}
+		key := void.DeriveKey(void.Conf.Passphrase, salt)
+		return key, &void.E2E{Salt: salt, Fingerprint: void.Fingerprint(key)}, nil
+	}
+
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	keys, err := loadKeyring()
+	if err != nil {
+		return nil, nil, err
+	}
+	e := &void.E2E{Fingerprint: void.Fingerprint(key)}
+	keys[e.Fingerprint] = key
+	if err := saveKeyring(keys); err != nil {
+		return nil, nil, err
+	}
+	return key, e, nil
+}
+
+// e2eKey returns the key of a file that was encrypted before the upload.
+func e2eKey(e *void.E2E) ([]byte, error) {
+	var key []byte
+	if len(e.Salt) > 0 {
+		if void.Conf.Passphrase == "" {
+			return nil, errors.New("file is encrypted by a passphrase, missing VOID_PASSPHRASE")
+		}
+		key = void.DeriveKey(void.Conf.Passphrase, e.Salt)
+	} else {
+		keys, err := loadKeyring()
+		if err != nil {
+			return nil, err
+		}
+		key = keys[e.Fingerprint]
+	}
+	if key == nil || void.Fingerprint(key) != e.Fingerprint {
+		return nil, fmt.Errorf("no key of fingerprint %s, wrong passphrase or keyring", e.Fingerprint)
+	}
+	return key, nil
+}
+
+// sealed returns a reader of the given content sealed by the key.
+func sealed(content io.Reader, key []byte) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := store.Seal(pw, content, key)
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// loadKeyring loads the local keyring, which maps the fingerprints to
+// the keys.
+func loadKeyring() (map[string][]byte, error) {
+	if void.Conf.Keyring == "" {
+		return nil, errors.New("missing VOID_KEYRING")
+	}
+	keys := map[string][]byte{}
+	b, err := os.ReadFile(void.Conf.Keyring)
+	if errors.Is(err, fs.ErrNotExist) {
+		return keys, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, fmt.Errorf("invalid keyring %s: %w", void.Conf.Keyring, err)
+	}
+	return keys, nil
+}
+
+func saveKeyring(keys map[string][]byte) error {
+	b, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(void.Conf.Keyring), 0700); err != nil {
+		return err
+	}
+	tmp := void.Conf.Keyring + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, void.Conf.Keyring)
+}
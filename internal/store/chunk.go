@@ -0,0 +1,261 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package store
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/poly1305"
+)
+
+// The chunk layout is the same as the one of the Telegram files that
+// are written by tgstore: the plaintext is split into chunks of
+// chunkSize bytes, and each chunk is sealed by chacha20poly1305 and
+// prefixed by its nonce. The nonce is a little endian counter that
+// starts at 1.
+const (
+	chunkSize          = 64 << 10
+	encryptedChunkSize = chacha20poly1305.NonceSize + chunkSize + poly1305.TagSize
+	chunkOverhead      = encryptedChunkSize - chunkSize
+)
+
+// encryptChunks reads the plaintext from r, and writes the sealed chunks
+// to w.
+func encryptChunks(w io.Writer, r io.Reader, aead cipher.AEAD) (n int64, err error) {
+	buf := make([]byte, encryptedChunkSize)
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	for counter := uint64(1); ; counter++ {
+		m, err := io.ReadFull(r, buf[:chunkSize])
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return n, nil
+			} else if !errors.Is(err, io.ErrUnexpectedEOF) {
+				return n, err
+			}
+		}
+
+		binary.LittleEndian.PutUint64(nonce, counter)
+		if _, err := w.Write(nonce); err != nil {
+			return n, err
+		}
+		if _, err := w.Write(aead.Seal(buf[:0], nonce, buf[:m], nil)); err != nil {
+			return n, err
+		}
+		n += int64(m)
+	}
+}
+
+// plainSize returns the plaintext size of the given encrypted size.
+func plainSize(size int64) int64 {
+	full := size / encryptedChunkSize
+	n := full * chunkSize
+	if rest := size - full*encryptedChunkSize; rest > chunkOverhead {
+		n += rest - chunkOverhead
+	}
+	return n
+}
+
+// chunkReader decrypts the sealed chunks of an io.ReaderAt.
+type chunkReader struct {
+	mu     sync.Mutex
+	r      io.ReaderAt
+	closer io.Closer
+	aead   cipher.AEAD
+	size   int64 // plaintext size
+	offset int64
+	closed bool
+
+	buf   []byte
+	chunk []byte // the decrypted chunk at index idx
+	idx   int64
+}
+
+func newChunkReader(r io.ReaderAt, c io.Closer, aead cipher.AEAD, encryptedSize int64) *chunkReader {
+	return &chunkReader{
+		r:      r,
+		closer: c,
+		aead:   aead,
+		size:   plainSize(encryptedSize),
+		buf:    make([]byte, encryptedChunkSize),
+		idx:    -1,
+	}
+}
+
+// load decrypts the chunk at index idx.
+func (cr *chunkReader) load(idx int64) error {
+	if cr.idx == idx {
+		return nil
+	}
+
+	n, err := cr.r.ReadAt(cr.buf, idx*encryptedChunkSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if n <= chunkOverhead {
+		return io.ErrUnexpectedEOF
+	}
+
+	nonce := cr.buf[:chacha20poly1305.NonceSize]
+	if binary.LittleEndian.Uint64(nonce) != uint64(idx+1) {
+		return fmt.Errorf("chunk %d is out of order", idx)
+	}
+	cr.chunk, err = cr.aead.Open(cr.chunk[:0], nonce, cr.buf[chacha20poly1305.NonceSize:n], nil)
+	if err != nil {
+		cr.idx = -1
+		return fmt.Errorf("chunk %d: %w", idx, err)
+	}
+	cr.idx = idx
+	return nil
+}
+
+// Read implements io.Reader.
+func (cr *chunkReader) Read(b []byte) (int, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if cr.closed {
+		return 0, fs.ErrClosed
+	} else if cr.offset >= cr.size {
+		return 0, io.EOF
+	}
+
+	idx := cr.offset / chunkSize
+	if err := cr.load(idx); err != nil {
+		return 0, err
+	}
+	n := copy(b, cr.chunk[cr.offset-idx*chunkSize:])
+	cr.offset += int64(n)
+	return n, nil
+}
+
+// Seek implements io.Seeker.
+func (cr *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if cr.closed {
+		return 0, fs.ErrClosed
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += cr.offset
+	case io.SeekEnd:
+		offset += cr.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	cr.offset = offset
+	return cr.offset, nil
+}
+
+// Close implements io.Closer.
+func (cr *chunkReader) Close() error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if cr.closed {
+		return fs.ErrClosed
+	}
+	cr.closed = true
+	if cr.closer == nil {
+		return nil
+	}
+	return cr.closer.Close()
+}
+
+// Seal reads the plaintext from r, and writes the chunks sealed by the
+// given key to w, in the same layout as the objects in the backends.
+// The sealed content is the same for the same key and plaintext.
+func Seal(w io.Writer, r io.Reader, key []byte) (n int64, err error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return 0, err
+	}
+	return encryptChunks(w, r, aead)
+}
+
+// PlainSize returns the plaintext size of the given sealed size.
+func PlainSize(size int64) int64 {
+	return plainSize(size)
+}
+
+// SealedSize returns the sealed size of the given plaintext size.
+func SealedSize(size int64) int64 {
+	chunks := (size + chunkSize - 1) / chunkSize
+	return size + chunks*chunkOverhead
+}
+
+// Unseal returns a reader of the plaintext of the chunks that are read
+// from r and were sealed by the given key.
+func Unseal(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &unsealReader{r: r, aead: aead, buf: make([]byte, encryptedChunkSize)}, nil
+}
+
+// unsealReader decrypts the sealed chunks of an io.Reader in order.
+type unsealReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	buf   []byte
+	chunk []byte // the rest of the current decrypted chunk
+	idx   uint64 // the index of the next chunk
+	err   error
+}
+
+// Read implements io.Reader.
+func (ur *unsealReader) Read(b []byte) (int, error) {
+	for len(ur.chunk) == 0 {
+		if ur.err != nil {
+			return 0, ur.err
+		}
+
+		n, err := io.ReadFull(ur.r, ur.buf)
+		switch {
+		case errors.Is(err, io.EOF):
+			ur.err = io.EOF
+			continue
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			// A short chunk is the last one.
+			ur.err = io.EOF
+		case err != nil:
+			return 0, err
+		}
+		if n <= chunkOverhead {
+			ur.err = io.ErrUnexpectedEOF
+			return 0, ur.err
+		}
+
+		nonce := ur.buf[:chacha20poly1305.NonceSize]
+		if binary.LittleEndian.Uint64(nonce) != ur.idx+1 {
+			ur.err = fmt.Errorf("chunk %d is out of order", ur.idx)
+			return 0, ur.err
+		}
+		ur.chunk, err = ur.aead.Open(ur.buf[chacha20poly1305.NonceSize:chacha20poly1305.NonceSize], nonce, ur.buf[chacha20poly1305.NonceSize:n], nil)
+		if err != nil {
+			ur.err = fmt.Errorf("chunk %d: %w", ur.idx, err)
+			return 0, ur.err
+		}
+		ur.idx++
+	}
+
+	n := copy(b, ur.chunk)
+	ur.chunk = ur.chunk[n:]
+	return n, nil
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// checkSeeks seeks the given reader of the given content to positions
+// around the chunk boundaries by every whence, and checks what it reads.
+func checkSeeks(t *testing.T, r io.ReadSeeker, data []byte) {
+	t.Helper()
+
+	size := int64(len(data))
+	tests := []struct {
+		offset int64
+		whence int
+		pos    int64
+	}{
+		{0, io.SeekStart, 0},
+		{chunkSize - 1, io.SeekStart, chunkSize - 1},
+		{chunkSize + 7, io.SeekStart, chunkSize + 7},
+		{-10, io.SeekCurrent, chunkSize - 3},
+		{0, io.SeekEnd, size},
+		{-1, io.SeekEnd, size - 1},
+		{-chunkSize - 1, io.SeekEnd, size - chunkSize - 1},
+		{size + 5, io.SeekStart, size + 5},
+	}
+	for _, tt := range tests {
+		if tt.pos < 0 {
+			continue
+		}
+		pos, err := r.Seek(tt.offset, tt.whence)
+		if err != nil || pos != tt.pos {
+			t.Fatalf("Seek(%d, %d) = %d, %v, want %d", tt.offset, tt.whence, pos, err, tt.pos)
+		}
+		want := []byte{}
+		if pos < size {
+			want = data[pos:min64(size, pos+100)]
+		}
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(r, got); err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("read %d bytes at %d: %v", len(want), pos, err)
+		}
+		if _, err := r.Seek(pos, io.SeekStart); err != nil {
+			t.Fatalf("seek back to %d: %v", pos, err)
+		}
+	}
+
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Fatalf("seek to a negative position did not fail")
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("seek to the start: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read all: got %d bytes, want %d: %v", len(got), len(data), err)
+	}
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func TestChunkReaderSeek(t *testing.T) {
+	l, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatalf("new local: %v", err)
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	for _, size := range []int{0, 1, chunkSize, chunkSize + 1, 3*chunkSize + 123} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			data := make([]byte, size)
+			rand.Read(data)
+			id, err := l.Upload(context.Background(), key, bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("upload: %v", err)
+			}
+			r, err := l.Download(context.Background(), key, id)
+			if err != nil {
+				t.Fatalf("download: %v", err)
+			}
+			defer r.Close()
+			checkSeeks(t, r, data)
+		})
+	}
+}
@@ -0,0 +1,397 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// stripeBlockSize is the number of bytes that a stripe stores in each
+// of its shards.
+const stripeBlockSize = 64 << 10
+
+// shardKDF derives the key of each shard from the key of the object by
+// HKDF-SHA256 with the index of the shard, so that no two shards are
+// encrypted under the same key and nonces.
+const shardKDF = "hkdf-sha256"
+
+// Shards describes the layout of an erasure coded object.
+//
+// The object is cut into stripes of Data*BlockSize bytes. Each stripe
+// is split into Data blocks that go to the data shards, and Parity
+// blocks are computed from them for the parity shards. The last stripe
+// is padded with zeros. Each shard is encrypted under its own key that
+// is derived by KDF, shards of objects without it share the key of the
+// object.
+type Shards struct {
+	Data      int       `json:"data"`
+	Parity    int       `json:"parity"`
+	BlockSize int64     `json:"block_size"`
+	Size      int64     `json:"size"`
+	KDF       string    `json:"kdf,omitempty"`
+	Shards    []Replica `json:"shards"`
+}
+
+// ShardKey returns the key of shard i of an object of the given key.
+func (s *Shards) ShardKey(key []byte, i int) ([]byte, error) {
+	switch s.KDF {
+	case "":
+		return key, nil
+	case shardKDF:
+		k := make([]byte, len(key))
+		r := hkdf.New(sha256.New, key, nil, []byte("void shard "+strconv.Itoa(i)))
+		if _, err := io.ReadFull(r, k); err != nil {
+			return nil, err
+		}
+		return k, nil
+	default:
+		return nil, fmt.Errorf("unsupported shard key derivation %q", s.KDF)
+	}
+}
+
+// Erasure spreads Reed-Solomon coded shards of an object over its
+// backends, and rebuilds the object from any Data of them.
+type Erasure struct {
+	Backends Replicated
+	Data     int
+	Parity   int
+}
+
+// Upload uploads the content as Data+Parity shards, each under its own
+// key that is derived from the given key. The shards are assigned to
+// the backends in a round-robin fashion.
+func (e *Erasure) Upload(ctx context.Context, key []byte, content io.Reader) (*Shards, error) {
+	if len(e.Backends) == 0 {
+		return nil, errors.New("no backend for the shards")
+	}
+	code, err := newRSCode(e.Data, e.Parity)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	n := e.Data + e.Parity
+	var (
+		wg   sync.WaitGroup
+		s    = &Shards{Data: e.Data, Parity: e.Parity, BlockSize: stripeBlockSize, KDF: shardKDF, Shards: make([]Replica, n)}
+		errs = make([]error, n)
+		pws  = make([]*io.PipeWriter, n)
+	)
+	for i := 0; i < n; i++ {
+		pr, pw := io.Pipe()
+		pws[i] = pw
+		b := e.Backends[i%len(e.Backends)]
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var id string
+			k, err := s.ShardKey(key, i)
+			if err == nil {
+				id, err = b.Upload(ctx, k, pr)
+			}
+			pr.CloseWithError(err)
+			if err != nil {
+				errs[i] = fmt.Errorf("shard %d on %s: %w", i, b.Name, err)
+				cancel()
+				return
+			}
+			s.Shards[i] = Replica{Backend: b.Name, UploadId: id}
+		}(i)
+	}
+
+	err = s.encode(code, content, pws)
+	for _, pw := range pws {
+		pw.CloseWithError(err)
+	}
+	wg.Wait()
+
+	for _, e := range errs {
+		if e != nil {
+			return nil, e
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ShardSize returns the size of each shard.
+func (s *Shards) ShardSize() int64 {
+	stripe := int64(s.Data) * s.BlockSize
+	return (s.Size + stripe - 1) / stripe * s.BlockSize
+}
+
+// encode writes the stripes of the content to the shard writers.
+func (s *Shards) encode(code *rsCode, content io.Reader, ws []*io.PipeWriter) error {
+	stripe := make([]byte, int64(s.Data)*s.BlockSize)
+	blocks := make([][]byte, s.Data+s.Parity)
+	for i := range blocks {
+		if i < s.Data {
+			blocks[i] = stripe[int64(i)*s.BlockSize : int64(i+1)*s.BlockSize]
+		} else {
+			blocks[i] = make([]byte, s.BlockSize)
+		}
+	}
+
+	for {
+		n, err := io.ReadFull(content, stripe)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		for i := n; i < len(stripe); i++ {
+			stripe[i] = 0
+		}
+		s.Size += int64(n)
+
+		code.encode(blocks[:s.Data], blocks[s.Data:])
+		for i, b := range blocks {
+			if _, err := ws[i].Write(b); err != nil {
+				return err
+			}
+		}
+		if n < len(stripe) {
+			return nil
+		}
+	}
+}
+
+// Download returns a reader of the object that is described by the
+// given shards.
+func (e *Erasure) Download(ctx context.Context, key []byte, s *Shards) (io.ReadSeekCloser, error) {
+	code, err := newRSCode(s.Data, s.Parity)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.Shards) != s.Data+s.Parity || s.BlockSize <= 0 {
+		return nil, errors.New("invalid shard layout")
+	}
+
+	n := len(s.Shards)
+	er := &erasureReader{
+		ctx:      ctx,
+		key:      key,
+		backends: e.Backends,
+		s:        s,
+		code:     code,
+		readers:  make([]io.ReadSeekCloser, n),
+		pos:      make([]int64, n),
+		failed:   make([]bool, n),
+		stripe:   -1,
+		buf:      make([]byte, int64(s.Data)*s.BlockSize),
+	}
+	return er, nil
+}
+
+// Delete removes all shards of an object. It removes as many shards as
+// possible and returns the first error if any.
+func (e *Erasure) Delete(ctx context.Context, s *Shards) error {
+	return e.Backends.Delete(ctx, s.Shards)
+}
+
+// erasureReader reads an erasure coded object stripe by stripe.
+type erasureReader struct {
+	ctx      context.Context
+	key      []byte
+	backends Replicated
+	s        *Shards
+	code     *rsCode
+
+	mu      sync.Mutex
+	readers []io.ReadSeekCloser
+	pos     []int64
+	failed  []bool
+	offset  int64
+	closed  bool
+	stripe  int64  // the index of the stripe in buf
+	buf     []byte // the data of the current stripe
+}
+
+// block reads the block of the given stripe from shard i.
+func (er *erasureReader) block(i int, stripe int64, b []byte) (err error) {
+	defer func() {
+		if err != nil {
+			er.failed[i] = true
+			if er.readers[i] != nil {
+				er.readers[i].Close()
+				er.readers[i] = nil
+			}
+		}
+	}()
+
+	if er.readers[i] == nil {
+		r := er.s.Shards[i]
+		var bk Backend
+		bk, err = er.backends.Lookup(r.Backend)
+		if err != nil {
+			return err
+		}
+		var key []byte
+		key, err = er.s.ShardKey(er.key, i)
+		if err != nil {
+			return err
+		}
+		er.readers[i], err = bk.Download(er.ctx, key, r.UploadId)
+		if err != nil {
+			return err
+		}
+		er.pos[i] = 0
+	}
+
+	off := stripe * er.s.BlockSize
+	if er.pos[i] != off {
+		if _, err = er.readers[i].Seek(off, io.SeekStart); err != nil {
+			return err
+		}
+		er.pos[i] = off
+	}
+	_, err = io.ReadFull(er.readers[i], b)
+	if err != nil {
+		return err
+	}
+	er.pos[i] += int64(len(b))
+	return nil
+}
+
+// load loads the data of the given stripe into buf. It prefers the data
+// shards, and falls back to the parity shards for reconstruction.
+func (er *erasureReader) load(stripe int64) error {
+	if er.stripe == stripe {
+		return nil
+	}
+	er.stripe = -1
+
+	var (
+		k      = er.s.Data
+		bs     = er.s.BlockSize
+		idx    []int
+		shards [][]byte
+		err    error
+	)
+	for i := range er.s.Shards {
+		if len(idx) == k {
+			break
+		}
+		if er.failed[i] {
+			continue
+		}
+		var b []byte
+		if i < k {
+			b = er.buf[int64(i)*bs : int64(i+1)*bs]
+		} else {
+			b = make([]byte, bs)
+		}
+		if e := er.block(i, stripe, b); e != nil {
+			if er.ctx.Err() != nil {
+				return er.ctx.Err()
+			}
+			err = fmt.Errorf("shard %d: %w", i, e)
+			continue
+		}
+		idx = append(idx, i)
+		shards = append(shards, b)
+	}
+	if len(idx) < k {
+		return fmt.Errorf("not enough shards to rebuild the object: %w", err)
+	}
+
+	if idx[k-1] != k-1 {
+		data := make([][]byte, k)
+		for j := range data {
+			data[j] = make([]byte, bs)
+		}
+		if err := er.code.reconstruct(idx, shards, data); err != nil {
+			return err
+		}
+		for j, d := range data {
+			copy(er.buf[int64(j)*bs:], d)
+		}
+	}
+	er.stripe = stripe
+	return nil
+}
+
+// Read implements io.Reader.
+func (er *erasureReader) Read(b []byte) (int, error) {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+
+	if er.closed {
+		return 0, fs.ErrClosed
+	} else if er.offset >= er.s.Size {
+		return 0, io.EOF
+	}
+
+	stripeSize := int64(len(er.buf))
+	stripe := er.offset / stripeSize
+	if err := er.load(stripe); err != nil {
+		return 0, err
+	}
+	start := er.offset - stripe*stripeSize
+	end := stripeSize
+	if rest := er.s.Size - stripe*stripeSize; rest < end {
+		end = rest
+	}
+	n := copy(b, er.buf[start:end])
+	er.offset += int64(n)
+	return n, nil
+}
+
+// Seek implements io.Seeker.
+func (er *erasureReader) Seek(offset int64, whence int) (int64, error) {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+
+	if er.closed {
+		return 0, fs.ErrClosed
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += er.offset
+	case io.SeekEnd:
+		offset += er.s.Size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	er.offset = offset
+	return er.offset, nil
+}
+
+// Close implements io.Closer.
+func (er *erasureReader) Close() error {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+
+	if er.closed {
+		return fs.ErrClosed
+	}
+	er.closed = true
+	for i, r := range er.readers {
+		if r != nil {
+			r.Close()
+			er.readers[i] = nil
+		}
+	}
+	return nil
+}
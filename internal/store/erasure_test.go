@@ -0,0 +1,125 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestErasureReconstruct(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	tests := []struct {
+		data, parity int
+		size         int
+	}{
+		{2, 1, 0},
+		{2, 1, 100},
+		{3, 2, 2*stripeBlockSize + 1},
+		{4, 2, 5*stripeBlockSize + 333},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d+%d/%d", tt.data, tt.parity, tt.size), func(t *testing.T) {
+			e := &Erasure{Backends: localBackends(t, tt.data+tt.parity), Data: tt.data, Parity: tt.parity}
+			content := make([]byte, tt.size)
+			rand.Read(content)
+			s, err := e.Upload(context.Background(), key, bytes.NewReader(content))
+			if err != nil {
+				t.Fatalf("upload: %v", err)
+			}
+
+			// Shards are removed one after another, the object is
+			// readable until more than Parity shards are missing.
+			for missing := 0; missing <= tt.parity+1; missing++ {
+				if missing > 0 {
+					r := s.Shards[missing-1]
+					b, _ := e.Backends.Lookup(r.Backend)
+					if err := b.Delete(context.Background(), r.UploadId); err != nil {
+						t.Fatalf("delete shard %d: %v", missing-1, err)
+					}
+				}
+
+				r, err := e.Download(context.Background(), key, s)
+				if err != nil {
+					t.Fatalf("%d shards missing: download: %v", missing, err)
+				}
+				if missing > tt.parity {
+					if _, err := r.Read(make([]byte, 1)); err == nil && tt.size > 0 {
+						t.Fatalf("%d shards missing: read did not fail", missing)
+					}
+					r.Close()
+					continue
+				}
+				checkSeeks(t, r, content)
+				r.Close()
+			}
+		})
+	}
+}
+
+func TestShardKeys(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	content := make([]byte, 3*stripeBlockSize+5)
+	rand.Read(content)
+
+	e := &Erasure{Backends: localBackends(t, 3), Data: 2, Parity: 1}
+	s, err := e.Upload(context.Background(), key, bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+
+	// No shard is encrypted under the key of the object, or under the
+	// key of another shard.
+	keys := map[string]bool{string(key): true}
+	for i, r := range s.Shards {
+		k, err := s.ShardKey(key, i)
+		if err != nil || keys[string(k)] {
+			t.Fatalf("shard %d has a shared key: %v", i, err)
+		}
+		keys[string(k)] = true
+
+		b, _ := e.Backends.Lookup(r.Backend)
+		if f, err := b.Download(context.Background(), key, r.UploadId); err == nil {
+			_, err = io.ReadAll(f)
+			f.Close()
+			if err == nil {
+				t.Fatalf("shard %d opens by the key of the object", i)
+			}
+		}
+	}
+
+	// Shards that were uploaded under the key of the object remain
+	// readable.
+	legacy := *s
+	legacy.KDF = ""
+	legacy.Shards = make([]Replica, len(s.Shards))
+	for i, r := range s.Shards {
+		b, _ := e.Backends.Lookup(r.Backend)
+		k, _ := s.ShardKey(key, i)
+		f, err := b.Download(context.Background(), k, r.UploadId)
+		if err != nil {
+			t.Fatalf("download shard %d: %v", i, err)
+		}
+		id, err := b.Upload(context.Background(), key, f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("upload shard %d: %v", i, err)
+		}
+		legacy.Shards[i] = Replica{Backend: r.Backend, UploadId: id}
+	}
+	r, err := e.Download(context.Background(), key, &legacy)
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	defer r.Close()
+	checkSeeks(t, r, content)
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"changkun.de/x/void/internal/uuid"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Local is a backend that stores objects as files in a local directory.
+// Each object is encrypted into the same chunk layout as a Telegram file
+// written by tgstore, which makes it suitable for air-gapped deployments
+// and for development where no Telegram bot is available.
+type Local struct {
+	dir string
+}
+
+// NewLocal returns a backend that stores objects in the given directory.
+// The directory is created if it does not exist.
+func NewLocal(dir string) (*Local, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create local store: %w", err)
+	}
+	return &Local{dir: dir}, nil
+}
+
+// Upload implements Backend.
+func (l *Local) Upload(ctx context.Context, key []byte, content io.Reader) (id string, err error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return "", err
+	}
+	id = uuid.Must(uuid.NewShort())
+
+	f, err := os.CreateTemp(l.dir, ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	_, err = encryptChunks(f, &ctxReader{ctx: ctx, r: content}, aead)
+	if err != nil {
+		return "", err
+	}
+	err = f.Sync()
+	if err != nil {
+		return "", err
+	}
+	err = f.Close()
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(f.Name(), l.path(id))
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Download implements Backend.
+func (l *Local) Download(ctx context.Context, key []byte, id string) (io.ReadSeekCloser, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	if !validID(id) {
+		return nil, os.ErrNotExist
+	}
+
+	f, err := os.Open(l.path(id))
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return newChunkReader(f, f, aead, fi.Size()), nil
+}
+
+// Delete implements Backend.
+func (l *Local) Delete(ctx context.Context, id string) error {
+	if !validID(id) {
+		return os.ErrNotExist
+	}
+	return os.Remove(l.path(id))
+}
+
+// Stat implements Backend.
+func (l *Local) Stat(ctx context.Context, key []byte, id string) (int64, error) {
+	if !validID(id) {
+		return 0, os.ErrNotExist
+	}
+	fi, err := os.Stat(l.path(id))
+	if err != nil {
+		return 0, err
+	}
+	return plainSize(fi.Size()), nil
+}
+
+// List implements Lister. Objects that are still being uploaded are not
+// listed.
+func (l *Local) List(ctx context.Context) ([]Object, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var objs []Object
+	for _, e := range entries {
+		if e.IsDir() || !validID(e.Name()) {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue // removed since reading the directory
+		}
+		objs = append(objs, Object{
+			UploadId: e.Name(),
+			Size:     plainSize(fi.Size()),
+			ModTime:  fi.ModTime(),
+		})
+	}
+	return objs, nil
+}
+
+func (l *Local) path(id string) string {
+	return filepath.Join(l.dir, id)
+}
+
+// validID reports whether the id is safe to be used as a file name
+// inside the store directory.
+func validID(id string) bool {
+	return id != "" && id[0] != '.' && filepath.Base(id) == id
+}
+
+// ctxReader stops reading from the underlying reader once the context
+// is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *ctxReader) Read(b []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(b)
+}
@@ -0,0 +1,248 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+)
+
+// Named is a backend with a stable name that identifies where its
+// objects live, e.g. the Telegram chat or the local directory.
+type Named struct {
+	Name string
+	Backend
+}
+
+// Replica is a copy of an object stored in a named backend.
+type Replica struct {
+	Backend  string `json:"backend"`
+	UploadId string `json:"upload_id"`
+}
+
+// Replicated uploads every object to all of its backends, and downloads
+// from the first replica that is available.
+type Replicated []Named
+
+// Lookup returns the backend of the given name. An empty name refers to
+// the first backend, which is where objects were stored before they
+// were replicated.
+func (rs Replicated) Lookup(name string) (Backend, error) {
+	if name == "" && len(rs) > 0 {
+		return rs[0].Backend, nil
+	}
+	for _, r := range rs {
+		if r.Name == name {
+			return r.Backend, nil
+		}
+	}
+	return nil, fmt.Errorf("backend %s is not configured", name)
+}
+
+// Upload uploads the content to all backends concurrently. It fails if
+// any of the backends fails.
+func (rs Replicated) Upload(ctx context.Context, key []byte, content io.Reader) ([]Replica, error) {
+	if len(rs) == 1 {
+		id, err := rs[0].Upload(ctx, key, content)
+		if err != nil {
+			return nil, err
+		}
+		return []Replica{{Backend: rs[0].Name, UploadId: id}}, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		replicas = make([]Replica, len(rs))
+		errs     = make([]error, len(rs))
+		ws       = make([]io.Writer, len(rs))
+		pws      = make([]*io.PipeWriter, len(rs))
+	)
+	for i := range rs {
+		pr, pw := io.Pipe()
+		ws[i], pws[i] = pw, pw
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id, err := rs[i].Upload(ctx, key, pr)
+			// Unblock the writer in case the backend stopped reading.
+			pr.CloseWithError(err)
+			if err != nil {
+				errs[i] = fmt.Errorf("replica %s: %w", rs[i].Name, err)
+				cancel()
+				return
+			}
+			replicas[i] = Replica{Backend: rs[i].Name, UploadId: id}
+		}(i)
+	}
+
+	_, err := io.Copy(io.MultiWriter(ws...), content)
+	for _, pw := range pws {
+		pw.CloseWithError(err)
+	}
+	wg.Wait()
+
+	for _, e := range errs {
+		if e != nil {
+			return nil, e
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return replicas, nil
+}
+
+// Download returns a reader of the object that reads from the first
+// available replica, and falls back to the next replica if reading
+// from the current one fails.
+func (rs Replicated) Download(ctx context.Context, key []byte, replicas []Replica) (io.ReadSeekCloser, error) {
+	fr := &failoverReader{ctx: ctx, key: key, rs: rs, replicas: replicas}
+	if err := fr.next(); err != nil {
+		return nil, err
+	}
+	return fr, nil
+}
+
+// Delete removes all replicas of an object. It removes as many replicas
+// as possible, and replicas that no longer exist count as removed.
+//
+// If some replicas cannot be removed, the returned error wraps
+// ErrNotSupported only if retrying would not help with any of them.
+func (rs Replicated) Delete(ctx context.Context, replicas []Replica) error {
+	var err, unsupported error
+	for _, r := range replicas {
+		b, e := rs.Lookup(r.Backend)
+		if e == nil {
+			e = b.Delete(ctx, r.UploadId)
+		}
+		switch {
+		case e == nil, errors.Is(e, fs.ErrNotExist):
+		case errors.Is(e, ErrNotSupported):
+			if unsupported == nil {
+				unsupported = fmt.Errorf("replica %s: %w", r.Backend, e)
+			}
+		default:
+			if err == nil {
+				err = fmt.Errorf("replica %s: %w", r.Backend, e)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return unsupported
+}
+
+// failoverReader reads an object from its replicas one after another
+// until one succeeds.
+type failoverReader struct {
+	ctx      context.Context
+	key      []byte
+	rs       Replicated
+	replicas []Replica
+
+	mu     sync.Mutex
+	cur    io.ReadSeekCloser
+	offset int64
+	closed bool
+}
+
+// next switches to the next available replica at the current offset.
+// The current replica is kept if no other replica is available.
+func (fr *failoverReader) next() error {
+	err := error(fs.ErrNotExist)
+	for len(fr.replicas) > 0 {
+		r := fr.replicas[0]
+		fr.replicas = fr.replicas[1:]
+
+		var b Backend
+		b, err = fr.rs.Lookup(r.Backend)
+		if err != nil {
+			continue
+		}
+		var f io.ReadSeekCloser
+		f, err = b.Download(fr.ctx, fr.key, r.UploadId)
+		if err != nil {
+			err = fmt.Errorf("replica %s: %w", r.Backend, err)
+			continue
+		}
+		if fr.offset > 0 {
+			if _, err = f.Seek(fr.offset, io.SeekStart); err != nil {
+				f.Close()
+				continue
+			}
+		}
+		if fr.cur != nil {
+			fr.cur.Close()
+		}
+		fr.cur = f
+		return nil
+	}
+	return err
+}
+
+// Read implements io.Reader.
+func (fr *failoverReader) Read(b []byte) (int, error) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	if fr.closed {
+		return 0, fs.ErrClosed
+	}
+	for {
+		n, err := fr.cur.Read(b)
+		fr.offset += int64(n)
+		if err == nil || errors.Is(err, io.EOF) || fr.ctx.Err() != nil || len(fr.replicas) == 0 {
+			return n, err
+		}
+		if n > 0 {
+			// Deliver what we have, the failure shows up again with
+			// the next read.
+			return n, nil
+		}
+		if e := fr.next(); e != nil {
+			return 0, err
+		}
+	}
+}
+
+// Seek implements io.Seeker.
+func (fr *failoverReader) Seek(offset int64, whence int) (int64, error) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	if fr.closed {
+		return 0, fs.ErrClosed
+	}
+	n, err := fr.cur.Seek(offset, whence)
+	if err != nil {
+		return n, err
+	}
+	fr.offset = n
+	return n, nil
+}
+
+// Close implements io.Closer.
+func (fr *failoverReader) Close() error {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	if fr.closed {
+		return fs.ErrClosed
+	}
+	fr.closed = true
+	if fr.cur == nil {
+		return nil
+	}
+	return fr.cur.Close()
+}
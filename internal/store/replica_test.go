@@ -0,0 +1,113 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+)
+
+// localBackends returns n local backends in temporary directories.
+func localBackends(t *testing.T, n int) Replicated {
+	var rs Replicated
+	for i := 0; i < n; i++ {
+		l, err := NewLocal(t.TempDir())
+		if err != nil {
+			t.Fatalf("new local: %v", err)
+		}
+		rs = append(rs, Named{Name: fmt.Sprintf("local%d", i), Backend: l})
+	}
+	return rs
+}
+
+// corrupt flips a byte at the given offset of the stored object, or at
+// the offset from the end if it is negative.
+func corrupt(t *testing.T, b Backend, id string, off int64) {
+	t.Helper()
+	f, err := os.OpenFile(b.(*Local).path(id), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open %s: %v", id, err)
+	}
+	defer f.Close()
+	if off < 0 {
+		fi, _ := f.Stat()
+		off += fi.Size()
+	}
+	c := make([]byte, 1)
+	if _, err := f.ReadAt(c, off); err != nil {
+		t.Fatalf("read %s: %v", id, err)
+	}
+	c[0] ^= 0xff
+	if _, err := f.WriteAt(c, off); err != nil {
+		t.Fatalf("write %s: %v", id, err)
+	}
+}
+
+func TestReplicatedFailover(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	data := make([]byte, 3*chunkSize+123)
+	rand.Read(data)
+
+	const (
+		ok = iota
+		missing
+		corruptHead // the first chunk is corrupted
+		corruptTail // the last chunk is corrupted
+	)
+	tests := []struct {
+		name     string
+		replicas []int
+		readable bool
+	}{
+		{"healthy", []int{ok, ok, ok}, true},
+		{"first missing", []int{missing, ok, ok}, true},
+		{"first corrupted", []int{corruptHead, ok, ok}, true},
+		{"first corrupted at the end", []int{corruptTail, ok}, true},
+		{"only last healthy", []int{missing, corruptTail, ok}, true},
+		{"all missing", []int{missing, missing}, false},
+		{"all corrupted", []int{corruptHead, corruptTail}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := localBackends(t, len(tt.replicas))
+			replicas, err := rs.Upload(context.Background(), key, bytes.NewReader(data))
+			if err != nil || len(replicas) != len(rs) {
+				t.Fatalf("upload has %d replicas: %v", len(replicas), err)
+			}
+			for i, state := range tt.replicas {
+				b, id := rs[i].Backend, replicas[i].UploadId
+				switch state {
+				case missing:
+					if err := b.Delete(context.Background(), id); err != nil {
+						t.Fatalf("delete replica %d: %v", i, err)
+					}
+				case corruptHead:
+					corrupt(t, b, id, 100)
+				case corruptTail:
+					corrupt(t, b, id, -10)
+				}
+			}
+
+			r, err := rs.Download(context.Background(), key, replicas)
+			if err == nil {
+				var got []byte
+				got, err = io.ReadAll(r)
+				r.Close()
+				if err == nil && !bytes.Equal(got, data) {
+					t.Fatalf("download reads %d bytes of another content", len(got))
+				}
+			}
+			if (err == nil) != tt.readable {
+				t.Fatalf("download: %v, want success %v", err, tt.readable)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package store
+
+import "errors"
+
+// This file implements a systematic Reed-Solomon code over GF(2^8).
+// The encoding matrix is derived from a Vandermonde matrix such that
+// its top rows form the identity, thus the first k shards carry the
+// data as it is, and any k rows of it are invertible.
+
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+	gfMul [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+func gfPow(a byte, n int) byte {
+	r := byte(1)
+	for i := 0; i < n; i++ {
+		r = gfMul[r][a]
+	}
+	return r
+}
+
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for i := range m {
+		m[i] = make([]byte, cols)
+	}
+	return m
+}
+
+func (m matrix) mul(o matrix) matrix {
+	r := newMatrix(len(m), len(o[0]))
+	for i := range m {
+		for j := range o[0] {
+			var v byte
+			for k := range o {
+				v ^= gfMul[m[i][k]][o[k][j]]
+			}
+			r[i][j] = v
+		}
+	}
+	return r
+}
+
+var errSingular = errors.New("matrix is singular")
+
+// invert returns the inverse of a square matrix by Gauss-Jordan
+// elimination.
+func (m matrix) invert() (matrix, error) {
+	n := len(m)
+	w := newMatrix(n, 2*n)
+	for i := range m {
+		copy(w[i], m[i])
+		w[i][n+i] = 1
+	}
+
+	for c := 0; c < n; c++ {
+		p := c
+		for p < n && w[p][c] == 0 {
+			p++
+		}
+		if p == n {
+			return nil, errSingular
+		}
+		w[c], w[p] = w[p], w[c]
+
+		inv := gfInv(w[c][c])
+		for j := range w[c] {
+			w[c][j] = gfMul[w[c][j]][inv]
+		}
+		for i := range w {
+			if i == c || w[i][c] == 0 {
+				continue
+			}
+			f := w[i][c]
+			for j := range w[i] {
+				w[i][j] ^= gfMul[f][w[c][j]]
+			}
+		}
+	}
+
+	r := newMatrix(n, n)
+	for i := range w {
+		copy(r[i], w[i][n:])
+	}
+	return r, nil
+}
+
+// rsCode is a Reed-Solomon code of k data shards and m parity shards.
+type rsCode struct {
+	k, m int
+	enc  matrix // (k+m) x k
+}
+
+func newRSCode(k, m int) (*rsCode, error) {
+	if k <= 0 || m < 0 || k+m > 256 {
+		return nil, errors.New("invalid number of shards")
+	}
+
+	v := newMatrix(k+m, k)
+	for r := range v {
+		for c := range v[r] {
+			v[r][c] = gfPow(byte(r), c)
+		}
+	}
+	top, err := v[:k].invert()
+	if err != nil {
+		return nil, err
+	}
+	return &rsCode{k: k, m: m, enc: v.mul(top)}, nil
+}
+
+// encode computes the parity shards from the data shards. All shards
+// must be of the same size.
+func (c *rsCode) encode(data, parity [][]byte) {
+	for i, p := range parity {
+		row := c.enc[c.k+i]
+		for b := range p {
+			p[b] = 0
+		}
+		for j, d := range data {
+			mulAdd(p, d, row[j])
+		}
+	}
+}
+
+// reconstruct recovers the data shards from any k shards, where idx[t]
+// is the shard index of the given shards[t].
+func (c *rsCode) reconstruct(idx []int, shards, data [][]byte) error {
+	sub := make(matrix, c.k)
+	for t, i := range idx {
+		sub[t] = c.enc[i]
+	}
+	dec, err := sub.invert()
+	if err != nil {
+		return err
+	}
+	for j, d := range data {
+		for b := range d {
+			d[b] = 0
+		}
+		for t, s := range shards {
+			mulAdd(d, s, dec[j][t])
+		}
+	}
+	return nil
+}
+
+// mulAdd computes dst += f * src.
+func mulAdd(dst, src []byte, f byte) {
+	switch f {
+	case 0:
+		return
+	case 1:
+		for i, v := range src {
+			dst[i] ^= v
+		}
+		return
+	}
+	t := &gfMul[f]
+	for i, v := range src {
+		dst[i] ^= t[v]
+	}
+}
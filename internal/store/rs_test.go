@@ -0,0 +1,92 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package store
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"testing"
+)
+
+// missingSets returns all sets of at most m shard indices out of n.
+func missingSets(n, m int) [][]int {
+	sets := [][]int{nil}
+	var grow func(set []int, from int)
+	grow = func(set []int, from int) {
+		if len(set) == m {
+			return
+		}
+		for i := from; i < n; i++ {
+			s := append(append([]int(nil), set...), i)
+			sets = append(sets, s)
+			grow(s, i+1)
+		}
+	}
+	grow(nil, 0)
+	return sets
+}
+
+func TestRSReconstruct(t *testing.T) {
+	tests := []struct {
+		k, m int
+	}{
+		{1, 0},
+		{1, 2},
+		{2, 1},
+		{4, 2},
+		{6, 3},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d+%d", tt.k, tt.m), func(t *testing.T) {
+			code, err := newRSCode(tt.k, tt.m)
+			if err != nil {
+				t.Fatalf("new code: %v", err)
+			}
+			shards := make([][]byte, tt.k+tt.m)
+			for i := range shards {
+				shards[i] = make([]byte, 1000)
+				if i < tt.k {
+					rand.Read(shards[i])
+				}
+			}
+			code.encode(shards[:tt.k], shards[tt.k:])
+
+			for _, missing := range missingSets(tt.k+tt.m, tt.m) {
+				var (
+					idx   []int
+					avail [][]byte
+				)
+				for i := range shards {
+					if len(idx) < tt.k && !containsInt(missing, i) {
+						idx = append(idx, i)
+						avail = append(avail, shards[i])
+					}
+				}
+				data := make([][]byte, tt.k)
+				for i := range data {
+					data[i] = make([]byte, len(shards[0]))
+				}
+				if err := code.reconstruct(idx, avail, data); err != nil {
+					t.Fatalf("shards %v missing: %v", missing, err)
+				}
+				for i := range data {
+					if !bytes.Equal(data[i], shards[i]) {
+						t.Fatalf("shards %v missing: data shard %d differs", missing, i)
+					}
+				}
+			}
+		})
+	}
+}
+
+func containsInt(list []int, v int) bool {
+	for _, i := range list {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+// Package store implements the blob backends that void stores its
+// encrypted objects in.
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotSupported is returned if a backend cannot perform an operation.
+var ErrNotSupported = errors.New("operation is not supported by the backend")
+
+// Backend is a blob storage that stores objects under a secret key and
+// addresses them by an opaque upload ID.
+//
+// Download and Stat return an error that wraps fs.ErrNotExist if the
+// given upload ID does not exist.
+type Backend interface {
+	// Upload uploads the content and returns the upload ID of it.
+	Upload(ctx context.Context, key []byte, content io.Reader) (id string, err error)
+	// Download returns a reader of the object targeted by the upload ID.
+	Download(ctx context.Context, key []byte, id string) (io.ReadSeekCloser, error)
+	// Delete removes the object targeted by the upload ID.
+	Delete(ctx context.Context, id string) error
+	// Stat returns the size of the object targeted by the upload ID.
+	Stat(ctx context.Context, key []byte, id string) (size int64, err error)
+}
+
+// Object is an object listed by a Lister.
+type Object struct {
+	UploadId string
+	Size     int64
+	ModTime  time.Time
+}
+
+// Lister is implemented by backends that can enumerate their objects.
+type Lister interface {
+	List(ctx context.Context) ([]Object, error)
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.design/x/tgstore"
+)
+
+// telegramEndpoint is the endpoint of the Telegram Bot API.
+const telegramEndpoint = "https://api.telegram.org"
+
+// Telegram is a backend that stores objects in a Telegram chat.
+//
+// The underlying store only returns Telegram file IDs, but a file can
+// only be removed by deleting the message that carries it. Hence the
+// messages that are sent for an object are recorded while it uploads,
+// and its upload ID is the ID of the store followed by the IDs of the
+// messages, separated by dots. Objects that were uploaded before the
+// messages were recorded cannot be deleted.
+type Telegram struct {
+	endpoint string
+	token    string
+	chatID   int64
+	tgs      *tgstore.TGStore // downloads objects
+
+	mu   sync.Mutex
+	idle []*tgUploader
+}
+
+// tgUploader uploads one object at a time, and records the messages
+// that were sent for it.
+type tgUploader struct {
+	tgs  *tgstore.TGStore
+	sent *sentMessages
+}
+
+// NewTelegram returns a backend that uploads objects to the given chat
+// using the given bot token.
+func NewTelegram(token string, chatID int64) *Telegram {
+	return newTelegram(telegramEndpoint, token, chatID)
+}
+
+func newTelegram(endpoint, token string, chatID int64) *Telegram {
+	t := &Telegram{endpoint: endpoint, token: token, chatID: chatID}
+	t.tgs = t.newStore(http.DefaultClient)
+	return t
+}
+
+// newStore returns a store of the chat that talks to the Bot API by
+// the given client.
+func (t *Telegram) newStore(c *http.Client) *tgstore.TGStore {
+	tgs := tgstore.New()
+	tgs.BotAPIEndpoint = t.endpoint
+	tgs.BotToken = t.token
+	tgs.ChatID = t.chatID
+	tgs.HTTPClient = c
+	return tgs
+}
+
+// uploader returns an idle uploader, or a new one if all are busy.
+func (t *Telegram) uploader() *tgUploader {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n := len(t.idle); n > 0 {
+		u := t.idle[n-1]
+		t.idle = t.idle[:n-1]
+		return u
+	}
+	sent := &sentMessages{base: http.DefaultTransport}
+	return &tgUploader{tgs: t.newStore(&http.Client{Transport: sent}), sent: sent}
+}
+
+func (t *Telegram) release(u *tgUploader) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.idle = append(t.idle, u)
+}
+
+// Upload implements Backend. The messages of an upload that fails are
+// deleted again as far as possible.
+func (t *Telegram) Upload(ctx context.Context, key []byte, content io.Reader) (string, error) {
+	u := t.uploader()
+	defer t.release(u)
+
+	u.sent.ids = nil
+	id, err := u.tgs.Upload(ctx, key, content)
+	if err != nil {
+		for _, msg := range u.sent.ids {
+			t.deleteMessage(context.Background(), msg)
+		}
+		return "", err
+	}
+	for _, msg := range u.sent.ids {
+		id += "." + strconv.Itoa(msg)
+	}
+	return id, nil
+}
+
+// splitTelegramID splits the given upload ID into the ID of the store
+// and the IDs of the messages of the object.
+func splitTelegramID(id string) (string, []int, error) {
+	fields := strings.Split(id, ".")
+	msgs := make([]int, 0, len(fields)-1)
+	for _, f := range fields[1:] {
+		msg, err := strconv.Atoi(f)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid upload id %s", id)
+		}
+		msgs = append(msgs, msg)
+	}
+	return fields[0], msgs, nil
+}
+
+// Download implements Backend.
+func (t *Telegram) Download(ctx context.Context, key []byte, id string) (io.ReadSeekCloser, error) {
+	id, _, err := splitTelegramID(id)
+	if err != nil {
+		return nil, err
+	}
+	return t.tgs.Download(ctx, key, id)
+}
+
+// Delete implements Backend. Objects whose messages are unknown cannot
+// be deleted. Telegram only lets a bot delete messages that are older
+// than 48 hours if it is an administrator of a supergroup or channel
+// that may delete messages, otherwise the deletion is not supported.
+func (t *Telegram) Delete(ctx context.Context, id string) error {
+	tid, msgs, err := splitTelegramID(id)
+	if err != nil {
+		return err
+	}
+	if len(msgs) == 0 && tid != "0" {
+		return fmt.Errorf("delete %s: messages are unknown: %w", id, ErrNotSupported)
+	}
+	for _, msg := range msgs {
+		if err := t.deleteMessage(ctx, msg); err != nil {
+			return fmt.Errorf("delete %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// deleteMessage deletes the given message from the chat. A message that
+// does not exist anymore counts as deleted.
+func (t *Telegram) deleteMessage(ctx context.Context, msg int) error {
+	form := url.Values{
+		"chat_id":    {strconv.FormatInt(t.chatID, 10)},
+		"message_id": {strconv.Itoa(msg)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint+"/bot"+t.token+"/deleteMessage", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var r struct {
+		Ok          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("message %d: %s", msg, resp.Status)
+	}
+	switch {
+	case r.Ok, strings.Contains(r.Description, "message to delete not found"):
+		return nil
+	case strings.Contains(r.Description, "message can't be deleted"):
+		return fmt.Errorf("message %d: %s: %w", msg, r.Description, ErrNotSupported)
+	}
+	return fmt.Errorf("message %d: %s", msg, r.Description)
+}
+
+// Stat implements Backend.
+func (t *Telegram) Stat(ctx context.Context, key []byte, id string) (size int64, err error) {
+	f, err := t.Download(ctx, key, id)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.Seek(0, io.SeekEnd)
+}
+
+// sentMessages records the IDs of the messages that are sent by the
+// requests of a client.
+type sentMessages struct {
+	base http.RoundTripper
+	ids  []int
+}
+
+// RoundTrip implements http.RoundTripper.
+func (s *sentMessages) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := s.base.RoundTrip(req)
+	if err != nil || !strings.HasSuffix(req.URL.Path, "/sendDocument") {
+		return resp, err
+	}
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+
+	var r struct {
+		Ok     bool `json:"ok"`
+		Result struct {
+			MessageId int `json:"message_id"`
+		} `json:"result"`
+	}
+	if json.Unmarshal(b, &r) == nil && r.Ok {
+		s.ids = append(s.ids, r.Result.MessageId)
+	}
+	return resp, nil
+}
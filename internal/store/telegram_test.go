@@ -0,0 +1,169 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBotAPI is a Bot API server that keeps the documents of a chat in
+// memory.
+type fakeBotAPI struct {
+	mu       sync.Mutex
+	files    map[string][]byte // file ID to content
+	messages map[int]string    // message ID to file ID
+	next     int
+}
+
+func newFakeBotAPI(t *testing.T) (*fakeBotAPI, *httptest.Server) {
+	f := &fakeBotAPI{files: map[string][]byte{}, messages: map[int]string{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeBotAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if p := strings.TrimPrefix(r.URL.Path, "/file/bottoken/"); p != r.URL.Path {
+		b, ok := f.files[p]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, p, time.Time{}, bytes.NewReader(b))
+		return
+	}
+
+	reply := func(result interface{}) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": result})
+	}
+	switch method := strings.TrimPrefix(r.URL.Path, "/bottoken/"); method {
+	case "getMe":
+		reply(map[string]interface{}{"id": 1, "is_bot": true, "first_name": "void"})
+	case "getChat":
+		reply(map[string]interface{}{"id": 42, "type": "private"})
+	case "sendDocument":
+		// The document has no file name, thus it is not a form file.
+		mr, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var b []byte
+		for p, err := mr.NextPart(); err == nil; p, err = mr.NextPart() {
+			if p.FormName() == "document" {
+				b, _ = io.ReadAll(p)
+			}
+		}
+		f.next++
+		id := fmt.Sprintf("file%d", f.next)
+		f.files[id] = b
+		f.messages[f.next] = id
+		reply(map[string]interface{}{
+			"message_id": f.next,
+			"chat":       map[string]interface{}{"id": 42, "type": "private"},
+			"document":   map[string]interface{}{"file_id": id},
+		})
+	case "getFile":
+		var params map[string]string
+		json.NewDecoder(r.Body).Decode(&params)
+		if _, ok := f.files[params["file_id"]]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "error_code": 400, "description": "Bad Request: Not Found"})
+			return
+		}
+		reply(map[string]interface{}{"file_id": params["file_id"], "file_path": params["file_id"]})
+	case "deleteMessage":
+		r.ParseForm()
+		var msg int
+		fmt.Sscan(r.Form.Get("message_id"), &msg)
+		id, ok := f.messages[msg]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "error_code": 400, "description": "Bad Request: message to delete not found"})
+			return
+		}
+		delete(f.messages, msg)
+		delete(f.files, id)
+		reply(true)
+	default:
+		http.Error(w, "unknown method "+method, http.StatusNotFound)
+	}
+}
+
+func TestTelegramDelete(t *testing.T) {
+	f, srv := newFakeBotAPI(t)
+	tg := newTelegram(srv.URL, "token", 42)
+	ctx := context.Background()
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	tests := []struct {
+		name     string
+		size     int
+		messages int
+	}{
+		{"empty", 0, 0},
+		{"small", 100, 1},
+		{"chunks", 200 << 10, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := make([]byte, tt.size)
+			rand.Read(data)
+			id, err := tg.Upload(ctx, key, bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("upload: %v", err)
+			}
+			_, msgs, err := splitTelegramID(id)
+			if err != nil || len(msgs) != tt.messages {
+				t.Fatalf("upload id %s has messages %v, want %d: %v", id, msgs, tt.messages, err)
+			}
+
+			r, err := tg.Download(ctx, key, id)
+			if err != nil {
+				t.Fatalf("download: %v", err)
+			}
+			got, err := io.ReadAll(r)
+			r.Close()
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("download got %d bytes, want %d: %v", len(got), len(data), err)
+			}
+
+			if err := tg.Delete(ctx, id); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+			f.mu.Lock()
+			for _, msg := range msgs {
+				if _, ok := f.messages[msg]; ok {
+					t.Errorf("message %d was not deleted", msg)
+				}
+			}
+			f.mu.Unlock()
+			if err := tg.Delete(ctx, id); err != nil {
+				t.Fatalf("delete again: %v", err)
+			}
+		})
+	}
+
+	// Objects whose messages were not recorded cannot be deleted.
+	if err := tg.Delete(ctx, "0file1"); !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("delete of an object without messages: got %v, want %v", err, ErrNotSupported)
+	}
+}
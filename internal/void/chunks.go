@@ -0,0 +1,296 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+
+	"changkun.de/x/void/internal/cdc"
+	"changkun.de/x/void/internal/uuid"
+	"go.etcd.io/bbolt"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// chunkedPrefix is the prefix of the upload ids of chunked objects. The
+// content of a chunked object is stored in its chunks, and the upload
+// id only identifies the manifest.
+const chunkedPrefix = "cdc:"
+
+// Chunk is a content defined chunk of a file. Chunks of the same content
+// are stored once and shared by all files.
+type Chunk struct {
+	Object
+	Size int64 `json:"size"`
+}
+
+// chunked reports whether the content of the object is stored in chunks.
+func (o *Object) chunked() bool {
+	return strings.HasPrefix(o.UploadId, chunkedPrefix)
+}
+
+// HashChunks splits the content into chunks and returns them with only
+// their checksums and sizes.
+func HashChunks(content io.Reader) ([]Chunk, error) {
+	var chunks []Chunk
+	c := cdc.New(content)
+	for {
+		data, err := c.Next()
+		if errors.Is(err, io.EOF) {
+			return chunks, nil
+		} else if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(data)
+		chunks = append(chunks, Chunk{
+			Object: Object{Sha256: hex.EncodeToString(sum[:])},
+			Size:   int64(len(data)),
+		})
+	}
+}
+
+// PutChunks uploads the content of a file as content defined chunks and
+// records the chunk manifest in the given object. A chunk is uploaded
+// only if known returns nil for its checksum, otherwise the chunk shares
+// the returned object.
+func (st *Storage) PutChunks(ctx context.Context, o *Object, content io.Reader, known func(sum string) *Object) error {
+	h := sha256.New()
+	c := cdc.New(io.TeeReader(content, h))
+	uploaded := map[string]*Object{}
+
+	o.UploadId = chunkedPrefix + uuid.Must(uuid.NewShort())
+	o.Replicas, o.Shards, o.Chunks = nil, nil, nil
+	o.Codec, o.OrigSize = "", 0
+	for {
+		data, err := c.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(data)
+		ch := Chunk{Size: int64(len(data))}
+		ch.Sha256 = hex.EncodeToString(sum[:])
+		if ob := uploaded[ch.Sha256]; ob != nil {
+			ch.Object = *ob
+		} else if ob := known(ch.Sha256); ob != nil {
+			ch.Object = *ob
+		} else {
+			ch.Key, err = allocKey(chacha20poly1305.KeySize)
+			if err != nil {
+				return err
+			}
+			err = st.Put(ctx, &ch.Object, bytes.NewReader(data))
+			if err != nil {
+				return err
+			}
+			uploaded[ch.Sha256] = &ch.Object
+		}
+		o.Chunks = append(o.Chunks, ch)
+	}
+	o.Sha256 = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+// chunksReader reads the content of a chunked object.
+type chunksReader struct {
+	ctx     context.Context
+	st      *Storage
+	chunks  []Chunk
+	offsets []int64 // the offset of each chunk in the content
+	size    int64
+
+	mu     sync.Mutex
+	cur    io.ReadSeekCloser
+	idx    int // the index of the chunk that cur reads
+	offset int64
+	closed bool
+}
+
+func (st *Storage) openChunks(ctx context.Context, o *Object) *chunksReader {
+	cr := &chunksReader{ctx: ctx, st: st, chunks: o.Chunks, idx: -1}
+	for _, c := range o.Chunks {
+		cr.offsets = append(cr.offsets, cr.size)
+		cr.size += c.Size
+	}
+	return cr
+}
+
+// Read implements io.Reader.
+func (cr *chunksReader) Read(b []byte) (int, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if cr.closed {
+		return 0, fs.ErrClosed
+	} else if cr.offset >= cr.size {
+		return 0, io.EOF
+	}
+
+	idx := sort.Search(len(cr.offsets), func(i int) bool {
+		return cr.offsets[i] > cr.offset
+	}) - 1
+	if idx != cr.idx || cr.cur == nil {
+		if cr.cur != nil {
+			cr.cur.Close()
+			cr.cur = nil
+		}
+		f, err := cr.st.Open(cr.ctx, &cr.chunks[idx].Object)
+		if err != nil {
+			return 0, err
+		}
+		if off := cr.offset - cr.offsets[idx]; off > 0 {
+			if _, err := f.Seek(off, io.SeekStart); err != nil {
+				f.Close()
+				return 0, err
+			}
+		}
+		cr.cur, cr.idx = f, idx
+	}
+
+	rest := cr.offsets[idx] + cr.chunks[idx].Size - cr.offset
+	if int64(len(b)) > rest {
+		b = b[:rest]
+	}
+	n, err := cr.cur.Read(b)
+	cr.offset += int64(n)
+	if errors.Is(err, io.EOF) {
+		if int64(n) < rest {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (cr *chunksReader) Seek(offset int64, whence int) (int64, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if cr.closed {
+		return 0, fs.ErrClosed
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += cr.offset
+	case io.SeekEnd:
+		offset += cr.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != cr.offset && cr.cur != nil {
+		cr.cur.Close()
+		cr.cur = nil
+	}
+	cr.offset = offset
+	return cr.offset, nil
+}
+
+// Close implements io.Closer.
+func (cr *chunksReader) Close() error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if cr.closed {
+		return fs.ErrClosed
+	}
+	cr.closed = true
+	if cr.cur == nil {
+		return nil
+	}
+	return cr.cur.Close()
+}
+
+// knownChunk returns the stored object of the chunk of the given
+// checksum, or nil if there is none.
+func (s *Server) knownChunk(sum string) (o *Object) {
+	s.db.View(func(t *bbolt.Tx) error {
+		e, err := lookupObject(t, chunkBucket, sum)
+		if err == nil && e != nil {
+			o = &e.Object
+		}
+		return nil
+	})
+	return
+}
+
+// shareChunks takes a reference of every chunk of the given file in the
+// chunk index. Chunks that were uploaded although the same content is
+// already in the index share the indexed object, and their own objects
+// are returned as redundant.
+func shareChunks(t *bbolt.Tx, m *Metadata) (redundant []Object, err error) {
+	b := t.Bucket([]byte(chunkBucket))
+	for i := range m.Chunks {
+		c := &m.Chunks[i]
+		e, err := lookupObject(t, chunkBucket, c.Sha256)
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			e = &dedupEntry{Object: c.Object, Size: c.Size}
+		} else {
+			if e.UploadId != c.UploadId {
+				redundant = append(redundant, c.Object)
+				c.Object = e.Object
+			}
+			if e.Size == 0 {
+				e.Size = c.Size
+			}
+			c.Size = e.Size
+		}
+		e.Refs++
+
+		v, _ := json.Marshal(e)
+		if err := b.Put([]byte(c.Sha256), v); err != nil {
+			return nil, err
+		}
+	}
+	return redundant, nil
+}
+
+// releaseChunks drops the references of a chunked object to its chunks.
+// It returns the objects of the chunks that are no longer used.
+func releaseChunks(t *bbolt.Tx, o *Object) (unused []Object, err error) {
+	b := t.Bucket([]byte(chunkBucket))
+	for _, c := range o.Chunks {
+		e, err := lookupObject(t, chunkBucket, c.Sha256)
+		if err != nil {
+			return nil, err
+		}
+		if e == nil || e.UploadId != c.UploadId {
+			unused = append(unused, c.Object)
+			continue
+		}
+
+		e.Refs--
+		if e.Refs > 0 {
+			v, _ := json.Marshal(e)
+			err = b.Put([]byte(c.Sha256), v)
+		} else {
+			unused = append(unused, e.Object)
+			err = b.Delete([]byte(c.Sha256))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return unused, nil
+}
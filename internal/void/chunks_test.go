@@ -0,0 +1,97 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+
+	"changkun.de/x/void/internal/cdc"
+)
+
+// checkSeeks seeks the given reader of the given content forward and
+// backward by every whence, and checks what it reads.
+func checkSeeks(t *testing.T, r io.ReadSeeker, data []byte) {
+	t.Helper()
+
+	size := int64(len(data))
+	tests := []struct {
+		offset int64
+		whence int
+		pos    int64
+	}{
+		{size / 2, io.SeekStart, size / 2},
+		{10, io.SeekStart, 10},
+		{size / 3, io.SeekCurrent, 10 + size/3},
+		{-size / 4, io.SeekCurrent, 10 + size/3 - size/4},
+		{-100, io.SeekEnd, size - 100},
+		{0, io.SeekEnd, size},
+		{0, io.SeekStart, 0},
+	}
+	for _, tt := range tests {
+		pos, err := r.Seek(tt.offset, tt.whence)
+		if err != nil || pos != tt.pos {
+			t.Fatalf("Seek(%d, %d) = %d, %v, want %d", tt.offset, tt.whence, pos, err, tt.pos)
+		}
+		want := data[pos:]
+		if len(want) > 1000 {
+			want = want[:1000]
+		}
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(r, got); err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("read %d bytes at %d: %v", len(want), pos, err)
+		}
+		if _, err := r.Seek(pos, io.SeekStart); err != nil {
+			t.Fatalf("seek back to %d: %v", pos, err)
+		}
+	}
+
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Fatalf("seek to a negative position did not fail")
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("seek to the start: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read all: got %d bytes, want %d: %v", len(got), len(data), err)
+	}
+}
+
+func TestChunksReaderSeek(t *testing.T) {
+	s := newTestServer(t)
+	data := make([]byte, 6*cdc.AvgSize)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	tests := []struct {
+		name  string
+		codec string
+	}{
+		{"plain", ""},
+		{"compressed", codecGzip},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.store.codec = tt.codec
+			o := &Object{}
+			err := s.store.PutChunks(context.Background(), o, bytes.NewReader(data), func(string) *Object { return nil })
+			if err != nil {
+				t.Fatalf("put: %v", err)
+			}
+			if len(o.Chunks) < 2 {
+				t.Fatalf("content has only %d chunks", len(o.Chunks))
+			}
+			r, err := s.store.Open(context.Background(), o)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			defer r.Close()
+			checkSeeks(t, r, data)
+		})
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+)
+
+// codecGzip compresses the content by gzip before it is encrypted.
+const codecGzip = "gzip"
+
+// compress returns a reader of the compressed content. The size of the
+// content is reported to setSize once the content is read completely.
+func compress(codec string, content io.Reader, setSize func(int64)) (io.ReadCloser, error) {
+	if codec != codecGzip {
+		return nil, fmt.Errorf("unsupported codec %q", codec)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		n, err := io.Copy(zw, content)
+		if e := zw.Close(); err == nil {
+			err = e
+		}
+		if err == nil {
+			setSize(n)
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// decompressReader reads the decompressed content of a compressed
+// object. Seeking forward skips the content in between, and seeking
+// backward starts over from the beginning of the object.
+type decompressReader struct {
+	mu     sync.Mutex
+	raw    io.ReadSeekCloser
+	zr     *gzip.Reader
+	pos    int64 // the position of zr in the content
+	offset int64
+	size   int64
+	closed bool
+}
+
+func decompress(codec string, raw io.ReadSeekCloser, size int64) (io.ReadSeekCloser, error) {
+	if codec != codecGzip {
+		raw.Close()
+		return nil, fmt.Errorf("unsupported codec %q", codec)
+	}
+	return &decompressReader{raw: raw, size: size}, nil
+}
+
+// Read implements io.Reader.
+func (dr *decompressReader) Read(b []byte) (int, error) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	if dr.closed {
+		return 0, fs.ErrClosed
+	} else if dr.offset >= dr.size {
+		return 0, io.EOF
+	}
+
+	if dr.zr == nil || dr.offset < dr.pos {
+		if _, err := dr.raw.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		var err error
+		if dr.zr == nil {
+			dr.zr, err = gzip.NewReader(dr.raw)
+		} else {
+			err = dr.zr.Reset(dr.raw)
+		}
+		if err != nil {
+			return 0, err
+		}
+		dr.pos = 0
+	}
+	if dr.offset > dr.pos {
+		n, err := io.CopyN(io.Discard, dr.zr, dr.offset-dr.pos)
+		dr.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := dr.zr.Read(b)
+	dr.pos += int64(n)
+	dr.offset += int64(n)
+	if errors.Is(err, io.EOF) && dr.offset < dr.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (dr *decompressReader) Seek(offset int64, whence int) (int64, error) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	if dr.closed {
+		return 0, fs.ErrClosed
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += dr.offset
+	case io.SeekEnd:
+		offset += dr.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	dr.offset = offset
+	return dr.offset, nil
+}
+
+// Close implements io.Closer.
+func (dr *decompressReader) Close() error {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	if dr.closed {
+		return fs.ErrClosed
+	}
+	dr.closed = true
+	if dr.zr != nil {
+		dr.zr.Close()
+	}
+	return dr.raw.Close()
+}
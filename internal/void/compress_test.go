@@ -0,0 +1,46 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// readSeekCloser is a bytes.Reader that can be closed.
+type readSeekCloser struct{ *bytes.Reader }
+
+func (readSeekCloser) Close() error { return nil }
+
+func TestDecompressSeek(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"text", bytes.Repeat([]byte("void compresses files "), 50000)},
+		{"short", bytes.Repeat([]byte("void "), 60)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var size int64
+			zr, err := compress(codecGzip, bytes.NewReader(tt.data), func(n int64) { size = n })
+			if err != nil {
+				t.Fatalf("compress: %v", err)
+			}
+			raw, err := io.ReadAll(zr)
+			if err != nil || size != int64(len(tt.data)) {
+				t.Fatalf("compress reports %d bytes, want %d: %v", size, len(tt.data), err)
+			}
+
+			r, err := decompress(codecGzip, readSeekCloser{bytes.NewReader(raw)}, size)
+			if err != nil {
+				t.Fatalf("decompress: %v", err)
+			}
+			defer r.Close()
+			checkSeeks(t, r, tt.data)
+		})
+	}
+}
@@ -7,6 +7,7 @@ package void
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"io/fs"
 	"log"
 	"os"
@@ -15,24 +16,97 @@ import (
 	"strings"
 
 	"changkun.de/x/login"
+	"changkun.de/x/void/internal/store"
 )
 
 type config struct {
-	Port     string
-	BotToken string
-	ChatID   int64
-	DB       string
-	Auth     string
-	SSO      string
+	Port      string
+	MaxUpload int64 // the maximum bytes of an upload, or 0 for no limit
+	BotToken  string
+	ChatIDs   []int64
+	DB        string
+	Auth      string
+	SSO       string
+	Stores    []string
+	StoreDirs []string
+
+	// KEK is the master key that wraps the keys of files in the
+	// database, and OldKEKs are previous master keys during rotation.
+	KEK     []byte
+	OldKEKs [][]byte
+
+	// DirectUsers are the users that may access the backends directly
+	// and thus receive the keys of files.
+	DirectUsers []string
+
+	// SealNames seals the names of files by the master key, and only
+	// MetaUsers may see them, or every user if there is none.
+	SealNames bool
+	MetaUsers []string
+
+	// DataShards and ParityShards enables erasure coding if DataShards
+	// is positive.
+	DataShards   int
+	ParityShards int
+
+	// Scrub is the mode of the scrubber, either "off", "sample" or
+	// "full".
+	Scrub string
+
+	// Dedup enables files of the same content to share the object.
+	Dedup bool
+
+	// Chunking enables to upload files in content defined chunks, which
+	// are stored once and shared by all files.
+	Chunking bool
+
+	// Proxy lets the command line upload and download through the
+	// server, which then needs no access to the backends.
+	Proxy bool
+
+	// Passphrase derives the keys of files that are encrypted by the
+	// command line, otherwise their keys are kept in the Keyring file.
+	Passphrase string
+	Keyring    string
+
+	// Compress is the codec that compresses the contents of new files
+	// before they are encrypted, or empty if they are not compressed.
+	Compress string
+
+	// Versioning keeps the previous versions of a file that is uploaded
+	// to the same path again, of which VersionKeep versions are kept if
+	// positive, and versions of VersionDays days are kept if positive.
+	Versioning  bool
+	VersionKeep int
+	VersionDays int
+
+	// TrashDays is the days that deleted files are kept in the trash
+	// before they are purged, or 0 to delete files right away.
+	TrashDays int
 }
 
+const (
+	storeTelegram = "telegram"
+	storeLocal    = "local"
+)
+
 var Conf config
 
+// adminCommands are the commands that work directly on the database
+// file, which requires the same configuration as the server except the
+// port to listen on.
+var adminCommands = map[string]bool{
+	"fsck":   true,
+	"rekey":  true,
+	"rewrap": true,
+}
+
 func LoadConf() {
 	isServer := false
 	if flag.Args()[0] == "serv" {
 		isServer = true
 	}
+	isAdmin := adminCommands[flag.Args()[0]]
 
 	var err error
 	if isServer {
@@ -44,6 +118,49 @@ func LoadConf() {
 		if err != nil {
 			log.Fatalf(`VOID_PORT contains invalid digits after ":", expect eg. ":8088", got %s`, Conf.Port)
 		}
+		if v := os.Getenv("VOID_MAX_UPLOAD"); v != "" {
+			Conf.MaxUpload, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || Conf.MaxUpload < 0 {
+				log.Fatalf("VOID_MAX_UPLOAD is not a number of bytes, got %s", v)
+			}
+		}
+		for _, u := range strings.Split(os.Getenv("VOID_DIRECT_USERS"), ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				Conf.DirectUsers = append(Conf.DirectUsers, u)
+			}
+		}
+		for _, u := range strings.Split(os.Getenv("VOID_META_USERS"), ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				Conf.MetaUsers = append(Conf.MetaUsers, u)
+			}
+		}
+		if v := os.Getenv("VOID_VERSIONING"); v != "" {
+			Conf.Versioning, err = strconv.ParseBool(v)
+			if err != nil {
+				log.Fatalf("VOID_VERSIONING is not a boolean, got %s", v)
+			}
+		}
+		if v := os.Getenv("VOID_VERSION_KEEP"); v != "" {
+			Conf.VersionKeep, err = strconv.Atoi(v)
+			if err != nil || Conf.VersionKeep < 0 {
+				log.Fatalf("VOID_VERSION_KEEP is not a number of versions, got %s", v)
+			}
+		}
+		if v := os.Getenv("VOID_VERSION_DAYS"); v != "" {
+			Conf.VersionDays, err = strconv.Atoi(v)
+			if err != nil || Conf.VersionDays < 0 {
+				log.Fatalf("VOID_VERSION_DAYS is not a number of days, got %s", v)
+			}
+		}
+		Conf.TrashDays = defaultTrashDays
+		if v := os.Getenv("VOID_TRASH_DAYS"); v != "" {
+			Conf.TrashDays, err = strconv.Atoi(v)
+			if err != nil || Conf.TrashDays < 0 {
+				log.Fatalf("VOID_TRASH_DAYS is not a number of days, got %s", v)
+			}
+		}
+	}
+	if isServer || isAdmin {
 		Conf.DB, err = filepath.Abs(os.Getenv("VOID_DB"))
 		if err != nil {
 			log.Fatalf("invalid VOID_DB location: %s", Conf.DB)
@@ -58,6 +175,19 @@ func LoadConf() {
 		if !strings.HasSuffix(Conf.DB, ".db") {
 			log.Fatalf("VOID_DB refers to a non .db file: %s", Conf.DB)
 		}
+		Conf.KEK = loadKEK("VOID_KEK")
+		if k := loadKEK("VOID_KEK_OLD"); k != nil {
+			Conf.OldKEKs = append(Conf.OldKEKs, k)
+		}
+		if v := os.Getenv("VOID_SEAL_NAMES"); v != "" {
+			Conf.SealNames, err = strconv.ParseBool(v)
+			if err != nil {
+				log.Fatalf("VOID_SEAL_NAMES is not a boolean, got %s", v)
+			}
+			if Conf.SealNames && Conf.KEK == nil {
+				log.Fatalf("VOID_SEAL_NAMES requires VOID_KEK.")
+			}
+		}
 	} else {
 		username := os.Getenv("VOID_USER")
 		password := os.Getenv("VOID_PASS")
@@ -68,18 +198,135 @@ func LoadConf() {
 		if err != nil {
 			log.Fatalf("cannot login into the void system")
 		}
+		Conf.Passphrase = os.Getenv("VOID_PASSPHRASE")
+		Conf.Keyring = os.Getenv("VOID_KEYRING")
+		if dir, err := os.UserConfigDir(); Conf.Keyring == "" && err == nil {
+			Conf.Keyring = filepath.Join(dir, "void", "keyring.json")
+		}
+		if v := os.Getenv("VOID_PROXY"); v != "" {
+			Conf.Proxy, err = strconv.ParseBool(v)
+			if err != nil {
+				log.Fatalf("VOID_PROXY is not a boolean, got %s", v)
+			}
+		}
+		// The server stores the files, none of the backends and the
+		// storage settings are needed.
+		if Conf.Proxy {
+			return
+		}
+	}
+
+	// Every configured chat and directory keeps a replica of each file.
+	Conf.Stores = strings.Split(os.Getenv("VOID_STORE"), ",")
+	for i, st := range Conf.Stores {
+		switch st = strings.TrimSpace(st); st {
+		case "", storeTelegram:
+			Conf.Stores[i] = storeTelegram
+			Conf.BotToken = os.Getenv("VOID_TG_BOTTOKEN")
+			if Conf.BotToken == "" {
+				log.Fatalf("missing VOID_TG_BOTTOKEN.")
+			}
+			Conf.ChatIDs = nil
+			for _, id := range strings.Split(os.Getenv("VOID_TG_CHATID"), ",") {
+				chatID, err := strconv.ParseInt(strings.TrimSpace(id), 10, 0)
+				if err != nil {
+					log.Fatalf("VOID_TG_CHATID is not a list of integers")
+				}
+				Conf.ChatIDs = append(Conf.ChatIDs, chatID)
+			}
+		case storeLocal:
+			Conf.Stores[i] = storeLocal
+			Conf.StoreDirs = nil
+			for _, dir := range filepath.SplitList(os.Getenv("VOID_STORE_DIR")) {
+				dir, err = filepath.Abs(dir)
+				if err != nil {
+					log.Fatalf("invalid VOID_STORE_DIR location: %s", dir)
+				}
+				Conf.StoreDirs = append(Conf.StoreDirs, dir)
+			}
+			if len(Conf.StoreDirs) == 0 {
+				log.Fatalf("missing VOID_STORE_DIR.")
+			}
+		default:
+			log.Fatalf("VOID_STORE contains neither %q nor %q, got %s", storeTelegram, storeLocal, st)
+		}
+	}
+	if ec := os.Getenv("VOID_ERASURE"); ec != "" {
+		data, parity, ok := strings.Cut(ec, "+")
+		Conf.DataShards, err = strconv.Atoi(data)
+		if err != nil || !ok || Conf.DataShards <= 0 {
+			log.Fatalf(`VOID_ERASURE is not of the form "k+m", expect eg. "4+2", got %s`, ec)
+		}
+		Conf.ParityShards, err = strconv.Atoi(parity)
+		if err != nil || Conf.ParityShards < 0 || Conf.DataShards+Conf.ParityShards > 256 {
+			log.Fatalf(`VOID_ERASURE is not of the form "k+m", expect eg. "4+2", got %s`, ec)
+		}
+	}
+	Conf.Scrub = os.Getenv("VOID_SCRUB")
+	switch Conf.Scrub {
+	case "":
+		Conf.Scrub = scrubSample
+	case scrubOff, scrubSample, scrubFull:
+	default:
+		log.Fatalf("VOID_SCRUB is none of %q, %q and %q, got %s", scrubOff, scrubSample, scrubFull, Conf.Scrub)
+	}
+
+	if v := os.Getenv("VOID_DEDUP"); v != "" {
+		Conf.Dedup, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("VOID_DEDUP is not a boolean, got %s", v)
+		}
+	}
+
+	if v := os.Getenv("VOID_CDC"); v != "" {
+		Conf.Chunking, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("VOID_CDC is not a boolean, got %s", v)
+		}
 	}
 
-	Conf.BotToken = os.Getenv("VOID_TG_BOTTOKEN")
-	if Conf.BotToken == "" {
-		log.Fatalf("missing VOID_TG_BOTTOKEN.")
+	switch v := os.Getenv("VOID_COMPRESS"); v {
+	case "", "off":
+		Conf.Compress = ""
+	case codecGzip:
+		Conf.Compress = v
+	default:
+		log.Fatalf("VOID_COMPRESS is neither %q nor %q, got %s", "off", codecGzip, v)
 	}
-	Conf.ChatID, err = strconv.ParseInt(os.Getenv("VOID_TG_CHATID"), 10, 0)
-	if err != nil {
-		log.Fatalf("VOID_TG_CHATID is not an integer")
+
+	if isAdmin {
+		return
 	}
 	Conf.SSO = os.Getenv("VOID_LOGIN")
 	if Conf.SSO == "" {
 		log.Fatalf("missing VOID_LOGIN endpoint")
 	}
 }
+
+// NewBackends returns the blob backends selected by the configuration.
+func NewBackends() store.Replicated {
+	var rs store.Replicated
+	for _, st := range Conf.Stores {
+		switch st {
+		case storeTelegram:
+			for _, id := range Conf.ChatIDs {
+				rs = append(rs, store.Named{
+					Name:    fmt.Sprintf("%s:%d", storeTelegram, id),
+					Backend: store.NewTelegram(Conf.BotToken, id),
+				})
+			}
+		case storeLocal:
+			for _, dir := range Conf.StoreDirs {
+				l, err := store.NewLocal(dir)
+				if err != nil {
+					log.Fatalf("%v", err)
+				}
+				rs = append(rs, store.Named{
+					Name:    storeLocal + ":" + dir,
+					Backend: l,
+				})
+			}
+		}
+	}
+	return rs
+}
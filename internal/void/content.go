@@ -0,0 +1,99 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+)
+
+// contentReader serves the content of a file. The object is opened on
+// first use, so that requests that are answered by their preconditions
+// do not download anything. While the content is read from the start
+// to the end, its checksum is computed to verify full downloads.
+type contentReader struct {
+	ctx  context.Context
+	st   *Storage
+	meta *Metadata
+
+	f   io.ReadSeekCloser
+	err error // the first error of the object
+
+	h          hash.Hash
+	pos        int64
+	sequential bool // whether the content is read from the start
+}
+
+func newContentReader(ctx context.Context, st *Storage, meta *Metadata) *contentReader {
+	return &contentReader{ctx: ctx, st: st, meta: meta, h: sha256.New(), sequential: true}
+}
+
+func (cr *contentReader) open() error {
+	if cr.f != nil || cr.err != nil {
+		return cr.err
+	}
+	cr.f, cr.err = cr.st.Open(cr.ctx, &cr.meta.Object)
+	return cr.err
+}
+
+// Read implements io.Reader.
+func (cr *contentReader) Read(b []byte) (int, error) {
+	if err := cr.open(); err != nil {
+		return 0, err
+	}
+
+	n, err := cr.f.Read(b)
+	if cr.sequential {
+		cr.h.Write(b[:n])
+	}
+	cr.pos += int64(n)
+	switch {
+	case errors.Is(err, io.EOF) && cr.pos < cr.meta.FileSize:
+		cr.err = fmt.Errorf("truncated, expect %d bytes, got %d", cr.meta.FileSize, cr.pos)
+	case err != nil && !errors.Is(err, io.EOF):
+		cr.err = err
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (cr *contentReader) Seek(offset int64, whence int) (int64, error) {
+	if err := cr.open(); err != nil {
+		return 0, err
+	}
+
+	n, err := cr.f.Seek(offset, whence)
+	if err != nil {
+		cr.err = err
+		return n, err
+	}
+	cr.h.Reset()
+	cr.pos, cr.sequential = n, n == 0
+	return n, nil
+}
+
+// Close closes the object and reports a download error or a full
+// download that does not match the checksum of the file. The response
+// is already on its way, thus they can only be logged, and the client
+// should verify the digest.
+func (cr *contentReader) Close() error {
+	switch {
+	case cr.err != nil:
+		log.Printf("item %s download with error: %v\n", cr.meta.Id, cr.err)
+	case cr.sequential && cr.pos == cr.meta.FileSize && cr.meta.Sha256 != "" &&
+		hex.EncodeToString(cr.h.Sum(nil)) != cr.meta.Sha256:
+		log.Printf("item %s does not match its checksum\n", cr.meta.Id)
+	}
+	if cr.f == nil {
+		return nil
+	}
+	return cr.f.Close()
+}
@@ -0,0 +1,264 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"changkun.de/x/void/internal/uuid"
+	"go.etcd.io/bbolt"
+)
+
+// dedupEntry is an object that is shared by all files of its content.
+// The entries are keyed by the checksum of the content, which is either
+// computed by the server while it stores the content, or verified by
+// verifyUpload if the client reports it. Files that share an object take
+// the size of the entry, which is unknown in entries of older versions.
+type dedupEntry struct {
+	Object
+	Size int64 `json:"size,omitempty"`
+	Refs int   `json:"refs"`
+}
+
+// lookupObject returns the shared object of the given checksum in the
+// given index bucket, or nil if there is none.
+func lookupObject(t *bbolt.Tx, bucket, sha256 string) (*dedupEntry, error) {
+	if sha256 == "" {
+		return nil, nil
+	}
+	v := t.Bucket([]byte(bucket)).Get([]byte(sha256))
+	if v == nil {
+		return nil, nil
+	}
+	e := &dedupEntry{}
+	if err := json.Unmarshal(v, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// shareObject makes the given file share the object of an earlier file
+// of the same content if there is one, or registers the object of the
+// file to be shared otherwise. It returns the object of the file that
+// became redundant, if any.
+func shareObject(t *bbolt.Tx, m *Metadata) (redundant *Object, err error) {
+	if m.Sha256 == "" {
+		return nil, nil
+	}
+
+	e, err := lookupObject(t, dedupBucket, m.Sha256)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		e = &dedupEntry{Object: m.Object, Size: m.FileSize}
+	} else {
+		if e.UploadId != m.UploadId {
+			if m.UploadId != "" {
+				o := m.Object
+				redundant = &o
+			}
+			m.Object = e.Object
+		}
+		if e.Size == 0 {
+			e.Size = m.FileSize
+		}
+		m.FileSize = e.Size
+	}
+	e.Refs++
+
+	b, _ := json.Marshal(e)
+	return redundant, t.Bucket([]byte(dedupBucket)).Put([]byte(m.Sha256), b)
+}
+
+// verifyUpload verifies the object of a file that the client uploaded
+// by itself before the checksums that the client reported are added to
+// the indexes of shared objects, which only trust verified checksums.
+// Content that is indexed already is not read again, since the file
+// shares the indexed object instead of its own upload. Thus an object is
+// read back once at most, when it is indexed. Entries that do not know
+// their size are verified again.
+func (s *Server) verifyUpload(ctx context.Context, m *Metadata) error {
+	known := func(t *bbolt.Tx, bucket, sum string) bool {
+		e, err := lookupObject(t, bucket, sum)
+		return err == nil && e != nil && e.Size > 0
+	}
+	var (
+		whole  bool
+		chunks []int
+	)
+	s.db.View(func(t *bbolt.Tx) error {
+		if Conf.Dedup && m.Sha256 != "" {
+			// A file that shares the whole object shares its chunks.
+			if whole = !known(t, dedupBucket, m.Sha256); !whole {
+				return nil
+			}
+		}
+		for i, c := range m.Chunks {
+			if !known(t, chunkBucket, c.Sha256) {
+				chunks = append(chunks, i)
+			}
+		}
+		return nil
+	})
+	switch {
+	case whole:
+		return s.verifyObject(ctx, &m.Object, m.FileSize)
+	case len(chunks) > 0:
+		return s.verifyChunks(ctx, &m.Object, chunks)
+	}
+	return nil
+}
+
+// verifyObject reads the given object of a file of the given size back
+// from the backends, and checks that the content matches the size and
+// the checksums that the client reported, including those of the chunks.
+func (s *Server) verifyObject(ctx context.Context, o *Object, size int64) error {
+	parts := []*Object{o}
+	if o.chunked() {
+		parts = parts[:0]
+		for i := range o.Chunks {
+			parts = append(parts, &o.Chunks[i].Object)
+		}
+	}
+
+	whole := sha256.New()
+	var n int64
+	for i, p := range parts {
+		f, err := s.store.Open(ctx, p)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		m, err := io.Copy(io.MultiWriter(whole, h), f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		n += m
+		if o.chunked() && (m != o.Chunks[i].Size || hex.EncodeToString(h.Sum(nil)) != p.Sha256) {
+			return fmt.Errorf("chunk %d does not match its checksum", i)
+		}
+	}
+	if n != size {
+		return fmt.Errorf("content has %d bytes, expect %d", n, size)
+	}
+	if o.Sha256 != "" && hex.EncodeToString(whole.Sum(nil)) != o.Sha256 {
+		return errors.New("content does not match its checksum")
+	}
+	return nil
+}
+
+// verifyChunks reads the chunks of the given indices of the object back
+// from the backends, and checks their sizes and checksums.
+func (s *Server) verifyChunks(ctx context.Context, o *Object, idx []int) error {
+	for _, i := range idx {
+		c := &o.Chunks[i]
+		f, err := s.store.Open(ctx, &c.Object)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if n != c.Size || hex.EncodeToString(h.Sum(nil)) != c.Sha256 {
+			return fmt.Errorf("chunk %d does not match its checksum", i)
+		}
+	}
+	return nil
+}
+
+// releaseObject drops the reference of the given file to its object.
+// It reports whether the object is no longer used by any file.
+func releaseObject(t *bbolt.Tx, m *Metadata) (unused bool, err error) {
+	e, err := lookupObject(t, dedupBucket, m.Sha256)
+	if err != nil {
+		return false, err
+	}
+	if e == nil || e.UploadId != m.UploadId {
+		return true, nil
+	}
+
+	b := t.Bucket([]byte(dedupBucket))
+	e.Refs--
+	if e.Refs > 0 {
+		v, _ := json.Marshal(e)
+		return false, b.Put([]byte(m.Sha256), v)
+	}
+	return true, b.Delete([]byte(m.Sha256))
+}
+
+// commit stores the metadata of an uploaded file. The chunks of the
+// file are shared with other files, and if deduplication is enabled,
+// the file shares the object with earlier files of the same content.
+// The keys and the name of the file are sealed before they are stored,
+// and the objects that became redundant are removed. The file is linked
+// into the tree of folders at its requested path, and indexed by its
+// tags.
+func (s *Server) commit(ctx context.Context, m *Metadata) error {
+	if err := s.store.keys.wrapObject(&m.Object); err != nil {
+		return err
+	}
+	if err := s.sealName(m); err != nil {
+		return err
+	}
+
+	var queued [][]byte
+	err := s.db.Update(func(t *bbolt.Tx) error {
+		var redundant []Object
+		if m.chunked() {
+			objs, err := shareChunks(t, m)
+			if err != nil {
+				return err
+			}
+			redundant = append(redundant, objs...)
+		}
+		if Conf.Dedup {
+			o, err := shareObject(t, m)
+			if err != nil {
+				return err
+			}
+			if o != nil {
+				redundant = append(redundant, *o)
+			}
+		}
+		if Conf.Versioning {
+			if err := supersede(t, m); err != nil {
+				return err
+			}
+		}
+		if err := indexFile(t, m); err != nil {
+			return err
+		}
+		for i := range redundant {
+			id := []byte(uuid.Must(uuid.NewShort()))
+			q, err := queueObject(t, id, m.FileName, &redundant[i])
+			if err != nil {
+				return err
+			}
+			queued = append(queued, q...)
+		}
+
+		d, _ := json.Marshal(m)
+		return t.Bucket([]byte(fileBucket)).Put([]byte(m.Id), d)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range queued {
+		s.reap(ctx, id)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"changkun.de/x/void/internal/store"
+	"go.etcd.io/bbolt"
+)
+
+// put sends a PUT of the given metadata in the direct scope of the user
+// of the given request.
+func put(s *Server, r *http.Request, m *Metadata) (*httptest.ResponseRecorder, error) {
+	b, _ := json.Marshal(m)
+	req := httptest.NewRequest(http.MethodPut, "/void?scope=direct", bytes.NewReader(b)).WithContext(r.Context())
+	w := httptest.NewRecorder()
+	return w, s.handlePut(w, req)
+}
+
+// countingBackend counts the downloads from a backend.
+type countingBackend struct {
+	store.Backend
+	downloads int
+}
+
+func (b *countingBackend) Download(ctx context.Context, key []byte, id string) (io.ReadSeekCloser, error) {
+	b.downloads++
+	return b.Backend.Download(ctx, key, id)
+}
+
+// countDownloads counts the downloads from the backend of the server.
+func countDownloads(s *Server) *countingBackend {
+	b := &countingBackend{Backend: s.store.backends[0].Backend}
+	s.store.backends[0].Backend = b
+	return b
+}
+
+// directUser returns a request of a user of the direct scope.
+func directUser() *http.Request {
+	Conf.DirectUsers = []string{"alice"}
+	r := httptest.NewRequest(http.MethodGet, "/void", nil)
+	return r.WithContext(withUser(r.Context(), "alice"))
+}
+
+func TestPutVerify(t *testing.T) {
+	data := make([]byte, 100<<10)
+	rand.Read(data)
+	sum := sha256.Sum256(data)
+	forged := sha256.Sum256([]byte("other content"))
+
+	tests := []struct {
+		name   string
+		sha256 string
+		size   int64
+		ok     bool
+	}{
+		{"verified", hex.EncodeToString(sum[:]), int64(len(data)), true},
+		{"forged checksum", hex.EncodeToString(forged[:]), int64(len(data)), false},
+		{"wrong size", hex.EncodeToString(sum[:]), int64(len(data)) + 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			Conf.Dedup = true
+			r := directUser()
+			b := countDownloads(s)
+
+			// The server reserves the file, and the client uploads the
+			// content to the backend by itself.
+			w, err := put(s, r, &Metadata{FileName: "a.bin", FileSize: tt.size, Object: Object{Sha256: tt.sha256}})
+			if err != nil {
+				t.Fatalf("reserve: %v", err)
+			}
+			m := &Metadata{}
+			json.Unmarshal(w.Body.Bytes(), m)
+			if err := s.store.Put(r.Context(), &m.Object, bytes.NewReader(data)); err != nil {
+				t.Fatalf("upload: %v", err)
+			}
+			m.Sha256 = tt.sha256
+			_, err = put(s, r, m)
+			if (err == nil) != tt.ok {
+				t.Fatalf("commit: %v, want success %v", err, tt.ok)
+			}
+
+			var entry []byte
+			s.db.View(func(t *bbolt.Tx) error {
+				entry = t.Bucket([]byte(dedupBucket)).Get([]byte(tt.sha256))
+				return nil
+			})
+			if (entry != nil) != tt.ok {
+				t.Fatalf("checksum is indexed: %v, want %v", entry != nil, tt.ok)
+			}
+			if b.downloads != 1 {
+				t.Fatalf("commit reads the content %d times", b.downloads)
+			}
+		})
+	}
+}
+
+func TestPutShared(t *testing.T) {
+	data := make([]byte, 100<<10)
+	rand.Read(data)
+	sum := sha256.Sum256(data)
+	wrongSize := int64(len(data)) + 1
+
+	t.Run("reserved", func(t *testing.T) {
+		s := newTestServer(t)
+		Conf.Dedup = true
+		r := directUser()
+		postFile(t, s, "a.bin", data)
+		b := countDownloads(s)
+
+		// The reservation shares the object of the indexed content.
+		w, err := put(s, r, &Metadata{FileName: "b.bin", FileSize: wrongSize, Object: Object{Sha256: hex.EncodeToString(sum[:])}})
+		if err != nil {
+			t.Fatalf("reserve: %v", err)
+		}
+		m := &Metadata{}
+		json.Unmarshal(w.Body.Bytes(), m)
+		if m.UploadId == "" || m.FileSize != int64(len(data)) {
+			t.Fatalf("reservation shares object %q of %d bytes", m.UploadId, m.FileSize)
+		}
+		if b.downloads != 0 {
+			t.Fatalf("reservation reads the content %d times", b.downloads)
+		}
+		if got := metadata(t, s, nil, m.Id); got.FileSize != int64(len(data)) {
+			t.Fatalf("shared file has %d bytes", got.FileSize)
+		}
+	})
+
+	t.Run("committed", func(t *testing.T) {
+		s := newTestServer(t)
+		Conf.Dedup = true
+		r := directUser()
+
+		// The same content is indexed while the client uploads.
+		w, err := put(s, r, &Metadata{FileName: "b.bin", FileSize: wrongSize, Object: Object{Sha256: hex.EncodeToString(sum[:])}})
+		if err != nil {
+			t.Fatalf("reserve: %v", err)
+		}
+		m := &Metadata{}
+		json.Unmarshal(w.Body.Bytes(), m)
+		if err := s.store.Put(r.Context(), &m.Object, bytes.NewReader(data)); err != nil {
+			t.Fatalf("upload: %v", err)
+		}
+		postFile(t, s, "a.bin", data)
+		b := countDownloads(s)
+
+		m.Sha256 = hex.EncodeToString(sum[:])
+		if _, err := put(s, r, m); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+		if b.downloads != 0 {
+			t.Fatalf("commit reads the indexed content %d times", b.downloads)
+		}
+		if got := metadata(t, s, nil, m.Id); got.FileSize != int64(len(data)) {
+			t.Fatalf("shared file has %d bytes", got.FileSize)
+		}
+	})
+}
+
+func TestPostDedup(t *testing.T) {
+	s := newTestServer(t)
+	Conf.Dedup = true
+	data := []byte("hello void")
+	ids := postFiles(t, s, nil, []string{"a", "b"}, map[string][]byte{"a": data, "b": data})
+
+	a, b := metadata(t, s, nil, ids[0]), metadata(t, s, nil, ids[1])
+	if a.UploadId != b.UploadId {
+		t.Fatalf("files of the same content have objects %s and %s", a.UploadId, b.UploadId)
+	}
+	for i, id := range ids {
+		req := httptest.NewRequest(http.MethodDelete, "/void?id="+id, nil)
+		if err := s.handleDelete(httptest.NewRecorder(), req); err != nil {
+			t.Fatalf("delete %s: %v", id, err)
+		}
+		if i == 0 {
+			w, err := getFile(t, s, nil, "id="+ids[1])
+			if err != nil || !bytes.Equal(w.Body.Bytes(), data) {
+				t.Fatalf("shared content is lost: %v", err)
+			}
+		}
+	}
+	entries, _ := os.ReadDir(Conf.StoreDirs[0])
+	if len(entries) != 0 {
+		t.Fatalf("%d objects remain after all files are deleted", len(entries))
+	}
+}
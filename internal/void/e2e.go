@@ -0,0 +1,112 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// E2E describes the key of a file that the client encrypted before the
+// upload. The key never leaves the client, the server only stores the
+// sealed content as if it was the content of the file.
+type E2E struct {
+	// Salt is the KDF salt of a key that is derived from a passphrase,
+	// or empty for a key from the local keyring.
+	Salt []byte `json:"salt,omitempty"`
+	// Fingerprint identifies the key without revealing it.
+	Fingerprint string `json:"fingerprint"`
+	// Sealed is the user metadata sealed by the key, the server knows
+	// neither the file name nor the key.
+	Sealed []byte `json:"sealed,omitempty"`
+}
+
+// userMeta is the user metadata of a file that can be sealed.
+type userMeta struct {
+	FileName string            `json:"filename"`
+	Attrs    map[string]string `json:"attrs,omitempty"`
+}
+
+// sealMeta seals the user metadata by the given cipher, bound to the
+// additional data. The sealed metadata is prefixed by its nonce.
+func sealMeta(aead cipher.AEAD, um *userMeta, ad []byte) ([]byte, error) {
+	b, _ := json.Marshal(um)
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(b)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, b, ad), nil
+}
+
+// openMeta opens the user metadata that was sealed by sealMeta.
+func openMeta(aead cipher.AEAD, sealed, ad []byte) (*userMeta, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed metadata is too short")
+	}
+	b, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], ad)
+	if err != nil {
+		return nil, err
+	}
+	um := &userMeta{}
+	if err := json.Unmarshal(b, um); err != nil {
+		return nil, err
+	}
+	return um, nil
+}
+
+// metaCipher returns the cipher that seals the user metadata of a file
+// of the given key. Its key is derived from the file key, so that it is
+// independent of the encryption of the content.
+func metaCipher(key []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("void e2e metadata key"))
+	return chacha20poly1305.NewX(mac.Sum(nil))
+}
+
+// SealName seals the given file name by the key of the file.
+func SealName(key []byte, name string) ([]byte, error) {
+	aead, err := metaCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return sealMeta(aead, &userMeta{FileName: name}, nil)
+}
+
+// OpenName opens the file name that was sealed by the key of the file.
+func OpenName(key, sealed []byte) (string, error) {
+	aead, err := metaCipher(key)
+	if err != nil {
+		return "", err
+	}
+	um, err := openMeta(aead, sealed, nil)
+	if err != nil {
+		return "", err
+	}
+	return um.FileName, nil
+}
+
+// kdfIterations is the number of PBKDF2 iterations to derive a key from
+// a passphrase.
+const kdfIterations = 600000
+
+// DeriveKey derives a file key from the given passphrase and salt.
+func DeriveKey(passphrase string, salt []byte) []byte {
+	return pbkdf2.Key([]byte(passphrase), salt, kdfIterations, chacha20poly1305.KeySize, sha256.New)
+}
+
+// Fingerprint returns the fingerprint of the given key.
+func Fingerprint(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("void e2e key fingerprint"))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestDeriveKey(t *testing.T) {
+	// The keys are PBKDF2-HMAC-SHA256 with kdfIterations iterations,
+	// computed independently by Python's hashlib.pbkdf2_hmac.
+	tests := []struct {
+		passphrase string
+		salt       string // hex
+		key        string // hex
+	}{
+		{"passwd", "73616c74", "1074be241b7be078a90369fae10cdc0394cf64a6780904421bd79c51fd372db0"},
+		{"correct horse battery staple", "000102030405060708090a0b0c0d0e0f", "ef177144eec9420cbc1093d2a8b344a92bc506d0d4ec9c028dd19f8324d8c1e6"},
+		{"", "766f6964", "ddb80855e863af55abc63e8b03c477920bc3680cde402026806e4a95f5578167"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.passphrase, func(t *testing.T) {
+			salt, _ := hex.DecodeString(tt.salt)
+			if got := hex.EncodeToString(DeriveKey(tt.passphrase, salt)); got != tt.key {
+				t.Fatalf("DeriveKey(%q, %s) = %s, want %s", tt.passphrase, tt.salt, got, tt.key)
+			}
+		})
+	}
+}
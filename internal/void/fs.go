@@ -0,0 +1,432 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"strings"
+
+	"go.etcd.io/bbolt"
+)
+
+// The files are organized in a tree of folders. The dir bucket indexes
+// the tree by paths: a folder is keyed by its path with a trailing
+// slash, and a file is keyed by its path and refers to its id. Since
+// the keys are sorted, the content of a folder is a range of keys. The
+// root folder "/" always exists and is not stored.
+//
+// The name of a file in its folder is its file name, or its id if the
+// name is sealed, so that the index never contains sealed names.
+const fsPath = "/void/fs/"
+
+// Folder is the content of a folder. Its files are paginated, and the
+// subfolders are only on the first page.
+type Folder struct {
+	Path    string      `json:"path"`
+	Folders []string    `json:"folders"` // names of the subfolders
+	Files   []*Metadata `json:"files"`
+	Next    string      `json:"next,omitempty"` // cursor of the next page of files
+}
+
+// cleanPath returns the given path as an absolute path without a
+// trailing slash, except the root folder "/".
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// dirKey returns the key of the given folder.
+func dirKey(dir string) []byte {
+	if dir == "/" {
+		return []byte(dir)
+	}
+	return []byte(dir + "/")
+}
+
+// entryName returns the name of the given file in its folder.
+func entryName(m *Metadata) string {
+	switch name := strings.ReplaceAll(m.FileName, "/", "_"); name {
+	case "", ".", "..":
+		return m.Id
+	default:
+		return name
+	}
+}
+
+// lookupPath returns the id of the file at the given path, whether a
+// folder exists at the path, or neither if the path does not exist.
+func lookupPath(t *bbolt.Tx, p string) (id string, isDir bool) {
+	if p == "/" {
+		return "", true
+	}
+	b := t.Bucket([]byte(dirBucket))
+	if v := b.Get([]byte(p)); len(v) > 0 {
+		return string(v), false
+	}
+	// The value of a folder is empty, which may not be told apart from
+	// a missing key by Get.
+	k, _ := b.Cursor().Seek(dirKey(p))
+	return "", string(k) == string(dirKey(p))
+}
+
+// mkdirAll creates the given folder and all its missing parents within
+// the transaction.
+func mkdirAll(t *bbolt.Tx, dir string) error {
+	if dir == "/" {
+		return nil
+	}
+	if err := mkdirAll(t, path.Dir(dir)); err != nil {
+		return err
+	}
+	if id, _ := lookupPath(t, dir); id != "" {
+		return fmt.Errorf("%s is a file", dir)
+	}
+	return t.Bucket([]byte(dirBucket)).Put(dirKey(dir), []byte{})
+}
+
+// requestedPath returns the path that the given file requests in the
+// tree, regardless of whether it is taken.
+func requestedPath(m *Metadata) string {
+	dir, name := cleanPath(m.Path), entryName(m)
+	if m.Path != "" && !strings.HasSuffix(m.Path, "/") {
+		dir = path.Dir(dir)
+		if m.FileName != "" {
+			name = strings.ReplaceAll(path.Base(m.Path), "/", "_")
+		}
+	}
+	return path.Join(dir, name)
+}
+
+// linkFile links the given file into the tree within the transaction.
+// The path of the file is its requested path, or only its folder if it
+// ends with a slash, in which case the file keeps its name. Missing
+// folders are created, and a file that is named like an existing entry
+// is named after its id as well.
+func linkFile(t *bbolt.Tx, m *Metadata) error {
+	p := requestedPath(m)
+	dir, name := path.Dir(p), path.Base(p)
+	if err := mkdirAll(t, dir); err != nil {
+		return err
+	}
+
+	if id, isDir := lookupPath(t, p); (id != "" && id != m.Id) || isDir {
+		ext := path.Ext(name)
+		p = path.Join(dir, fmt.Sprintf("%s (%s)%s", strings.TrimSuffix(name, ext), m.Id, ext))
+	}
+	m.Path = p
+	return t.Bucket([]byte(dirBucket)).Put([]byte(p), []byte(m.Id))
+}
+
+// unlinkFile removes the given file from the tree within the
+// transaction.
+func unlinkFile(t *bbolt.Tx, m *Metadata) error {
+	if m.Path == "" {
+		return nil
+	}
+	b := t.Bucket([]byte(dirBucket))
+	if string(b.Get([]byte(m.Path))) != m.Id {
+		return nil
+	}
+	return b.Delete([]byte(m.Path))
+}
+
+// listFolder returns the content of the given folder within the
+// transaction. The files are as they are stored.
+func listFolder(t *bbolt.Tx, dir string) (*Folder, error) {
+	if _, isDir := lookupPath(t, dir); !isDir {
+		return nil, errors.New("folder does not exist")
+	}
+
+	f := &Folder{Path: dir, Folders: []string{}, Files: []*Metadata{}}
+	files := t.Bucket([]byte(fileBucket))
+	prefix := dirKey(dir)
+	c := t.Bucket([]byte(dirBucket)).Cursor()
+	for k, v := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, v = c.Next() {
+		name := strings.TrimPrefix(string(k), string(prefix))
+		switch i := strings.Index(name, "/"); {
+		case name == "":
+		case i == len(name)-1:
+			f.Folders = append(f.Folders, name[:i])
+		case i < 0:
+			m := &Metadata{}
+			if err := json.Unmarshal(files.Get(v), m); err != nil {
+				continue // reported by fsck
+			}
+			f.Files = append(f.Files, m)
+		}
+	}
+	return f, nil
+}
+
+// movePath moves the file or folder at the given source path to the
+// given destination within the transaction. If the destination is a
+// folder, the source is moved into it. The name of a moved file
+// becomes the name at its destination unless the name is sealed.
+func movePath(t *bbolt.Tx, src, dst string) error {
+	src, dst = cleanPath(src), cleanPath(dst)
+	srcId, srcIsDir := lookupPath(t, src)
+	switch {
+	case src == "/":
+		return errors.New("the root folder cannot be moved")
+	case srcId == "" && !srcIsDir:
+		return fmt.Errorf("%s does not exist", src)
+	}
+	if _, isDir := lookupPath(t, dst); isDir {
+		dst = path.Join(dst, path.Base(src))
+	}
+	if id, isDir := lookupPath(t, dst); id != "" || isDir {
+		return fmt.Errorf("%s exists already", dst)
+	}
+	if srcIsDir && strings.HasPrefix(dst+"/", src+"/") {
+		return fmt.Errorf("%s cannot be moved into itself", src)
+	}
+	if err := mkdirAll(t, path.Dir(dst)); err != nil {
+		return err
+	}
+
+	// Collect the entries first, the bucket must not be modified while
+	// iterating it.
+	b := t.Bucket([]byte(dirBucket))
+	moved := map[string][]byte{src: []byte(srcId)}
+	if srcIsDir {
+		moved = map[string][]byte{}
+		prefix := string(dirKey(src))
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, v = c.Next() {
+			moved[string(k)] = append([]byte(nil), v...)
+		}
+	}
+
+	files := t.Bucket([]byte(fileBucket))
+	for k, v := range moved {
+		if err := b.Delete([]byte(k)); err != nil {
+			return err
+		}
+		nk := dst + strings.TrimPrefix(k, src)
+		if err := b.Put([]byte(nk), v); err != nil {
+			return err
+		}
+		if len(v) == 0 {
+			continue
+		}
+
+		m := &Metadata{}
+		if err := json.Unmarshal(files.Get(v), m); err != nil {
+			return fmt.Errorf("file %s is broken: %w", v, err)
+		}
+		m.Path = nk
+		if !srcIsDir && m.FileName != "" {
+			m.FileName = path.Base(nk)
+		}
+		d, _ := json.Marshal(m)
+		if err := files.Put(v, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeFolder removes the given empty folder within the transaction.
+func removeFolder(t *bbolt.Tx, dir string) error {
+	if dir == "/" {
+		return errors.New("the root folder cannot be removed")
+	}
+	b := t.Bucket([]byte(dirBucket))
+	prefix := dirKey(dir)
+	c := b.Cursor()
+	k, _ := c.Seek(prefix)
+	if k == nil || string(k) != string(prefix) {
+		return fmt.Errorf("%s does not exist", dir)
+	}
+	if k, _ = c.Next(); k != nil && strings.HasPrefix(string(k), string(prefix)) {
+		return fmt.Errorf("%s is not empty", dir)
+	}
+	return b.Delete(prefix)
+}
+
+// indexFiles links the files that are not in the tree yet, which are
+// files of older versions, into the root folder.
+func indexFiles(db *bbolt.DB) error {
+	return db.Update(func(t *bbolt.Tx) error {
+		files := t.Bucket([]byte(fileBucket))
+		unlinked := map[string]*Metadata{}
+		files.ForEach(func(k, v []byte) error {
+			m := &Metadata{}
+			if err := json.Unmarshal(v, m); err == nil && m.Path == "" && m.Id == string(k) {
+				unlinked[m.Id] = m
+			}
+			return nil
+		})
+		for id, m := range unlinked {
+			if err := linkFile(t, m); err != nil {
+				return err
+			}
+			d, _ := json.Marshal(m)
+			if err := files.Put([]byte(id), d); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// handleFs serves the tree of folders. A GET responds a file like its
+// id does, or the content of a folder, which is a page or the JSON of
+// the Folder in the data mode, with a page of the files that are
+// filtered, sorted and paginated by the ListOptions in the request. A
+// POST creates a folder by op=mkdir, moves the entry to the path in
+// "to" by op=move, or rolls a file back to the version in "version" by
+// op=rollback. A PATCH edits a file like its id does. A DELETE removes
+// a file or an empty folder.
+func (s *Server) handleFs(w http.ResponseWriter, r *http.Request) (err error) {
+	p := cleanPath(strings.TrimPrefix(r.URL.Path, fsPath))
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		if r.URL.Query().Get("op") == "rollback" {
+			var id string
+			s.db.View(func(t *bbolt.Tx) error {
+				id, _ = lookupPath(t, p)
+				return nil
+			})
+			if id == "" {
+				return fmt.Errorf("%s is not a file", p)
+			}
+			return s.handleRollback(w, r, id)
+		}
+		err = s.db.Update(func(t *bbolt.Tx) error {
+			switch op := r.URL.Query().Get("op"); op {
+			case "mkdir":
+				return mkdirAll(t, p)
+			case "move":
+				to := r.URL.Query().Get("to")
+				if to == "" {
+					return errors.New("missing destination for the move")
+				}
+				return movePath(t, p, to)
+			default:
+				return fmt.Errorf("op %q is not supported", op)
+			}
+		})
+		return
+	case http.MethodPatch:
+		var id string
+		s.db.View(func(t *bbolt.Tx) error {
+			id, _ = lookupPath(t, p)
+			return nil
+		})
+		if id == "" {
+			return fmt.Errorf("%s is not a file", p)
+		}
+		return s.handlePatch(w, r, id)
+	case http.MethodDelete:
+		var queued [][]byte
+		err = s.db.Update(func(t *bbolt.Tx) (err error) {
+			id, isDir := lookupPath(t, p)
+			switch {
+			case isDir:
+				return removeFolder(t, p)
+			case id == "":
+				return fmt.Errorf("%s does not exist", p)
+			}
+			queued, err = deleteFile(t, id)
+			return
+		})
+		for _, id := range queued {
+			s.reap(r.Context(), id)
+		}
+		return
+	default:
+		return fmt.Errorf("%s is not supported", r.Method)
+	}
+
+	var (
+		id     string
+		folder *Folder
+	)
+	err = s.db.View(func(t *bbolt.Tx) (err error) {
+		id, _ = lookupPath(t, p)
+		if id == "" {
+			folder, err = listFolder(t, p)
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+	if id != "" {
+		return s.handleFile(w, r, id)
+	}
+
+	var opts *ListOptions
+	opts, err = parseListOptions(r.URL.Query())
+	if err != nil {
+		return
+	}
+	files := folder.Files[:0]
+	for _, m := range folder.Files {
+		if m = s.nameView(r, m.publicView()); opts.match(m) {
+			files = append(files, m)
+		}
+	}
+	folder.Files, folder.Next = opts.page(files)
+	if opts.Cursor != "" {
+		folder.Folders = nil
+	}
+	next := ""
+	if folder.Next != "" {
+		q := r.URL.Query()
+		q.Set("cursor", folder.Next)
+		next = r.URL.Path + "?" + q.Encode()
+		w.Header().Set("Link", "<"+next+`>; rel="next"`)
+	}
+	if r.URL.Query().Get("mode") == "data" {
+		b, _ := json.Marshal(folder)
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(b)
+		return
+	}
+
+	// crumbs are the links to the folder and all its parents.
+	type crumb struct{ Name, Path string }
+	crumbs := []crumb{{"/", "/"}}
+	for i, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if name != "" {
+			crumbs = append(crumbs, crumb{name + "/", path.Join(crumbs[i].Path, name)})
+		}
+	}
+	err = folderTmpl.Execute(w, struct {
+		*Folder
+		Crumbs   []crumb
+		Parent   string
+		NextPage string
+	}{folder, crumbs, path.Dir(p), next})
+	if err != nil {
+		err = fmt.Errorf("failed to render template: %w", err)
+	}
+	return
+}
+
+var folderTmpl = template.Must(template.Must(voidTmpl.Clone()).New("folder").Parse(`{{template "head"}}
+<body>
+<h1>{{range .Crumbs}}<a href="/void/fs{{.Path}}">{{.Name}}</a>{{end}}</h1>
+
+<table class="table">
+<tr><th>Name</th><th>ID</th><th>File Size</th></tr>
+{{if ne .Path "/"}}<tr><td><a href="/void/fs{{.Parent}}">../</a></td><td></td><td></td></tr>{{end}}
+{{range .Folders}}
+<tr><td><a href="/void/fs{{$.Path}}{{if ne $.Path "/"}}/{{end}}{{.}}">{{.}}/</a></td><td></td><td></td></tr>
+{{end}}
+{{range .Files}}
+<tr><td><a href="/void/fs{{.Path}}">{{.FileName}}</a></td><td>{{.Id}}</td><td>{{.FileSize}}</td></tr>
+{{end}}
+</table>
+{{if .NextPage}}<p><a href="{{.NextPage}}">next page</a></p>{{end}}
+{{template "foot"}}`))
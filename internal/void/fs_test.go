@@ -0,0 +1,160 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// getFolder sends a GET of the given folder in the data mode.
+func getFolder(t *testing.T, s *Server, p string, q url.Values) (*Folder, http.Header) {
+	t.Helper()
+	q.Set("mode", "data")
+	req := httptest.NewRequest(http.MethodGet, fsPath+p+"?"+q.Encode(), nil)
+	w := httptest.NewRecorder()
+	if err := s.handleFs(w, req); err != nil {
+		t.Fatalf("list %s: %v", p, err)
+	}
+	f := &Folder{}
+	if err := json.Unmarshal(w.Body.Bytes(), f); err != nil {
+		t.Fatalf("list %s responds %s: %v", p, w.Body, err)
+	}
+	return f, w.Header()
+}
+
+// fsRequest sends a request of the given method to the given path in
+// the tree of folders.
+func fsRequest(t *testing.T, s *Server, method, p, query string) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+	req := httptest.NewRequest(method, fsPath+p+"?"+query, nil)
+	w := httptest.NewRecorder()
+	return w, s.handleFs(w, req)
+}
+
+func TestFolders(t *testing.T) {
+	s := newTestServer(t)
+	data := []byte("hello void")
+	postFiles(t, s, httptest.NewRequest(http.MethodPost, "/void?dir=/docs", nil), []string{"a.txt"}, map[string][]byte{"a.txt": data})
+
+	// A file is addressed by its path, and named after its id as well
+	// if the path is taken.
+	w, err := fsRequest(t, s, http.MethodGet, "/docs/a.txt", "")
+	if err != nil || !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatalf("get by path responds %q: %v", w.Body, err)
+	}
+	id := postFiles(t, s, httptest.NewRequest(http.MethodPost, "/void?dir=/docs", nil), []string{"a.txt"}, map[string][]byte{"a.txt": data})[0]
+	f, _ := getFolder(t, s, "/docs", url.Values{})
+	if len(f.Files) != 2 || !strings.Contains(f.Files[0].Path+f.Files[1].Path, "a ("+id+").txt") {
+		t.Fatalf("folder lists %d files", len(f.Files))
+	}
+
+	// Moving into a folder keeps the name.
+	if _, err := fsRequest(t, s, http.MethodPost, "/archive", "op=mkdir"); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if _, err := fsRequest(t, s, http.MethodPost, "/docs/a.txt", "op=move&to=/archive"); err != nil {
+		t.Fatalf("move: %v", err)
+	}
+	if _, err := fsRequest(t, s, http.MethodGet, "/docs/a.txt", "mode=data"); err == nil {
+		t.Fatalf("moved file is still at its old path")
+	}
+	w, err = fsRequest(t, s, http.MethodGet, "/archive/a.txt", "")
+	if err != nil || !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatalf("get by the new path responds %q: %v", w.Body, err)
+	}
+
+	// Only empty folders are removed.
+	if _, err := fsRequest(t, s, http.MethodDelete, "/archive", ""); err == nil {
+		t.Fatalf("delete removes a folder that is not empty")
+	}
+	if _, err := fsRequest(t, s, http.MethodDelete, "/archive/a.txt", ""); err != nil {
+		t.Fatalf("delete file: %v", err)
+	}
+	if _, err := fsRequest(t, s, http.MethodDelete, "/archive", ""); err != nil {
+		t.Fatalf("delete empty folder: %v", err)
+	}
+	if f, _ := getFolder(t, s, "/", url.Values{}); len(f.Folders) != 1 || f.Folders[0] != "docs" {
+		t.Fatalf("root lists folders %v", f.Folders)
+	}
+}
+
+func TestFolderPages(t *testing.T) {
+	s := newTestServer(t)
+	var names []string
+	files := map[string][]byte{}
+	for i := 0; i < 7; i++ {
+		name := "f" + strconv.Itoa(i)
+		names = append(names, name)
+		files[name] = []byte("file " + name)
+	}
+	postFiles(t, s, httptest.NewRequest(http.MethodPost, "/void?dir=/dir", nil), names, files)
+	postFiles(t, s, httptest.NewRequest(http.MethodPost, "/void?dir=/dir/sub", nil), []string{"g"}, map[string][]byte{"g": []byte("file g")})
+
+	tests := []struct {
+		name  string
+		sort  string
+		limit int
+		pages int
+	}{
+		{"one page", "", 0, 1},
+		{"exact pages", "", 7, 1},
+		{"pages", "", 2, 4},
+		{"pages by name", "name", 3, 3},
+		{"pages by size", "size", 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := url.Values{}
+			if tt.sort != "" {
+				q.Set("sort", tt.sort)
+			}
+			if tt.limit > 0 {
+				q.Set("limit", strconv.Itoa(tt.limit))
+			}
+
+			var got []string
+			for page := 0; ; page++ {
+				f, h := getFolder(t, s, "/dir", q)
+				if subfolders := len(f.Folders) > 0; subfolders != (page == 0) {
+					t.Fatalf("page %d lists subfolders %v", page, f.Folders)
+				}
+				if tt.limit > 0 && len(f.Files) > tt.limit {
+					t.Fatalf("page %d has %d files", page, len(f.Files))
+				}
+				for _, m := range f.Files {
+					got = append(got, m.FileName)
+				}
+				if f.Next == "" {
+					if h.Get("Link") != "" || page+1 != tt.pages {
+						t.Fatalf("list ends after %d pages, want %d", page+1, tt.pages)
+					}
+					break
+				}
+				if h.Get("Link") == "" {
+					t.Fatalf("page %d has no link to the next page", page)
+				}
+				q.Set("cursor", f.Next)
+			}
+
+			sort.Strings(got)
+			if len(got) != len(names) {
+				t.Fatalf("pages list %v, want %v", got, names)
+			}
+			for i := range got {
+				if got[i] != names[i] {
+					t.Fatalf("pages list %v, want %v", got, names)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,447 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"changkun.de/x/void/internal/store"
+	"changkun.de/x/void/internal/uuid"
+	"go.etcd.io/bbolt"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Fsck checks the consistency of the database and the backends, and
+// reports every problem it finds. The problems are repaired if repair
+// is true. It returns the number of found problems.
+//
+// Orphaned objects are only detected in backends that can list their
+// objects. The Telegram Bot API cannot enumerate the messages of a chat,
+// thus orphans in the Telegram backend are neither found nor repaired,
+// and Fsck says so in its output.
+//
+// Fsck works directly on the database file, thus the server must not
+// be running.
+func Fsck(repair bool) (problems int) {
+	db := openDB()
+	defer db.Close()
+	st := NewStorage()
+
+	report := func(format string, args ...interface{}) {
+		problems++
+		log.Printf(format+"\n", args...)
+	}
+
+	// refs are all objects in the backends that are referenced by the
+	// database, everything else in the backends is an orphan.
+	refs := map[store.Replica]bool{}
+
+	err := db.Update(func(t *bbolt.Tx) error {
+		files := t.Bucket([]byte(fileBucket))
+		temps := t.Bucket([]byte(tempBucket))
+
+		dedups := t.Bucket([]byte(dedupBucket))
+		chunks := t.Bucket([]byte(chunkBucket))
+		dirs := t.Bucket([]byte(dirBucket))
+		tags := t.Bucket([]byte(tagBucket))
+
+		var (
+			sharers      = map[string]int{} // number of files sharing an object
+			manifests    = map[string]bool{}
+			chunkRefs    = map[string]int{} // number of references to a chunk
+			invalidFiles [][]byte
+			brokenFiles  [][]byte
+			renamedFiles = map[string]*Metadata{}
+			staleTemps   [][]byte
+
+			unlinkedFiles = map[string]*Metadata{}
+			missingTags   [][]byte
+		)
+		// count counts the references of a file or a version of a file.
+		count := func(m *Metadata) {
+			for _, o := range st.objects(&m.Object) {
+				refs[o] = true
+			}
+			if e, _ := lookupObject(t, dedupBucket, m.Sha256); e != nil && e.UploadId == m.UploadId {
+				sharers[m.Sha256]++
+			}
+			if m.chunked() && !manifests[m.UploadId] {
+				manifests[m.UploadId] = true
+				for _, c := range m.Chunks {
+					chunkRefs[c.Sha256]++
+				}
+			}
+		}
+		files.ForEach(func(k, v []byte) error {
+			m := &Metadata{}
+			if err := json.Unmarshal(v, m); err != nil {
+				report("files/%s: invalid record: %v", k, err)
+				invalidFiles = append(invalidFiles, k)
+				return nil
+			}
+			count(m)
+
+			switch {
+			case m.UploadId == "":
+				report("files/%s: missing upload id", k)
+				brokenFiles = append(brokenFiles, k)
+			case !m.chunked() && !validKey(st.keys, m.Key):
+				report("files/%s: missing or invalid key", k)
+				brokenFiles = append(brokenFiles, k)
+			case m.Id != string(k):
+				report("files/%s: record has a different id %q", k, m.Id)
+				renamedFiles[string(k)] = m
+			case m.Path == "" || string(dirs.Get([]byte(m.Path))) != m.Id:
+				report("files/%s: file is not in the folder tree", k)
+				unlinkedFiles[string(k)] = m
+			}
+			for _, tag := range m.Tags {
+				if tk := tagKey(tag, string(k)); tags.Get(tk) == nil {
+					report("files/%s: tag %q is not indexed", k, tag)
+					missingTags = append(missingTags, tk)
+				}
+			}
+			return nil
+		})
+		// Deleted files keep their objects, and a file that is in the
+		// trash but not deleted is only counted once.
+		trash := t.Bucket([]byte(trashBucket))
+		var staleTrash, undatedTrash [][]byte
+		trash.ForEach(func(k, v []byte) error {
+			m := &Metadata{}
+			if err := json.Unmarshal(v, m); err != nil {
+				report("trash/%s: invalid record: %v", k, err)
+				staleTrash = append(staleTrash, k)
+				return nil
+			}
+			if files.Get(k) != nil {
+				report("trash/%s: file is not deleted", k)
+				staleTrash = append(staleTrash, k)
+				return nil
+			}
+			if m.DeletedAt == nil {
+				// The retention starts over from the repair.
+				report("trash/%s: missing deletion time", k)
+				undatedTrash = append(undatedTrash, k)
+			}
+			count(m)
+			return nil
+		})
+
+		// Versions of missing files are not counted, and their objects
+		// are removed as orphans or unused shared objects.
+		versions := t.Bucket([]byte(versionBucket))
+		var staleVersions [][]byte
+		versions.ForEach(func(k, v []byte) error {
+			m := &Metadata{}
+			if err := json.Unmarshal(v, m); err != nil {
+				report("versions/%q: invalid record: %v", k, err)
+				staleVersions = append(staleVersions, k)
+				return nil
+			}
+			if files.Get([]byte(m.Id)) == nil && trash.Get([]byte(m.Id)) == nil {
+				report("versions/%q: version of missing file %s", k, m.Id)
+				staleVersions = append(staleVersions, k)
+				return nil
+			}
+			count(m)
+			return nil
+		})
+		var staleTags [][]byte
+		tags.ForEach(func(k, v []byte) error {
+			tag, _, _ := strings.Cut(string(k), "\x00")
+			m := &Metadata{}
+			if err := json.Unmarshal(files.Get(v), m); err != nil || !hasTags(m, []string{tag}) {
+				report("tags/%q: entry of file %s is stale", k, v)
+				staleTags = append(staleTags, k)
+			}
+			return nil
+		})
+		var (
+			staleEntries   [][]byte
+			missingFolders []string
+		)
+		dirs.ForEach(func(k, v []byte) error {
+			p := string(k)
+			if len(v) > 0 {
+				m := &Metadata{}
+				if err := json.Unmarshal(files.Get(v), m); err != nil || m.Path != p {
+					report("dirs/%s: entry of file %s is stale", k, v)
+					staleEntries = append(staleEntries, k)
+					return nil
+				}
+			}
+			dir := path.Dir(strings.TrimSuffix(p, "/"))
+			if _, isDir := lookupPath(t, dir); !isDir {
+				report("dirs/%s: parent folder %s does not exist", k, dir)
+				missingFolders = append(missingFolders, dir)
+			}
+			return nil
+		})
+		temps.ForEach(func(k, v []byte) error {
+			m := &Metadata{}
+			if err := json.Unmarshal(v, m); err != nil {
+				report("temps/%s: invalid record: %v", k, err)
+				staleTemps = append(staleTemps, k)
+				return nil
+			}
+
+			switch {
+			case files.Get(k) != nil:
+				report("temps/%s: reservation of a committed file", k)
+				staleTemps = append(staleTemps, k)
+			case time.Since(m.Expire) > 0:
+				report("temps/%s: reservation was expired at %v", k, m.Expire)
+				staleTemps = append(staleTemps, k)
+			}
+			return nil
+		})
+		uploads := t.Bucket([]byte(uploadBucket))
+		var staleUploads [][]byte
+		uploads.ForEach(func(k, v []byte) error {
+			u := &upload{}
+			if err := json.Unmarshal(v, u); err != nil {
+				report("uploads/%s: invalid record: %v", k, err)
+				staleUploads = append(staleUploads, k)
+				return nil
+			}
+			if time.Since(u.Expire) > 0 {
+				report("uploads/%s: upload was expired at %v", k, u.Expire)
+				staleUploads = append(staleUploads, k)
+			}
+			return nil
+		})
+		var (
+			miscounted = map[string]*dedupEntry{}
+			unused     = map[string]*dedupEntry{}
+		)
+		dedups.ForEach(func(k, v []byte) error {
+			e := &dedupEntry{}
+			if err := json.Unmarshal(v, e); err != nil {
+				report("dedups/%s: invalid record: %v", k, err)
+				return nil
+			}
+
+			n := sharers[string(k)]
+			switch {
+			case n == 0:
+				report("dedups/%s: shared object is not used by any file", k)
+				unused[string(k)] = e
+			case n != e.Refs:
+				report("dedups/%s: shared object has %d references, expect %d", k, e.Refs, n)
+				e.Refs = n
+				miscounted[string(k)] = e
+			}
+			for _, o := range st.objects(&e.Object) {
+				refs[o] = true
+			}
+			return nil
+		})
+		var (
+			miscountedChunks = map[string]*dedupEntry{}
+			unusedChunks     = map[string]*dedupEntry{}
+		)
+		chunks.ForEach(func(k, v []byte) error {
+			e := &dedupEntry{}
+			if err := json.Unmarshal(v, e); err != nil {
+				report("chunks/%s: invalid record: %v", k, err)
+				return nil
+			}
+
+			n := chunkRefs[string(k)]
+			switch {
+			case n == 0:
+				report("chunks/%s: chunk is not used by any file", k)
+				unusedChunks[string(k)] = e
+			case n != e.Refs:
+				report("chunks/%s: chunk has %d references, expect %d", k, e.Refs, n)
+				e.Refs = n
+				miscountedChunks[string(k)] = e
+			}
+			for _, o := range st.objects(&e.Object) {
+				refs[o] = true
+			}
+			return nil
+		})
+		for _, bucket := range []string{reapBucket, unreapBucket} {
+			t.Bucket([]byte(bucket)).ForEach(func(k, v []byte) error {
+				m := &Metadata{}
+				if err := json.Unmarshal(v, m); err != nil {
+					report("%s/%s: invalid record: %v", bucket, k, err)
+					return nil
+				}
+				for _, o := range st.objects(&m.Object) {
+					refs[o] = true
+				}
+				return nil
+			})
+		}
+
+		if !repair {
+			return nil
+		}
+		for _, k := range invalidFiles {
+			if err := files.Delete(k); err != nil {
+				return err
+			}
+		}
+		for _, k := range staleTrash {
+			if err := trash.Delete(k); err != nil {
+				return err
+			}
+		}
+		for _, k := range undatedTrash {
+			m := &Metadata{}
+			json.Unmarshal(trash.Get(k), m)
+			now := time.Now().UTC()
+			m.DeletedAt = &now
+			b, _ := json.Marshal(m)
+			if err := trash.Put(k, b); err != nil {
+				return err
+			}
+		}
+		for _, k := range staleVersions {
+			if err := versions.Delete(k); err != nil {
+				return err
+			}
+		}
+		// The tags are repaired first, so that removing broken files
+		// removes their tags as well.
+		for _, k := range staleTags {
+			if err := tags.Delete(k); err != nil {
+				return err
+			}
+		}
+		for _, k := range missingTags {
+			_, id, _ := strings.Cut(string(k), "\x00")
+			if err := tags.Put(k, []byte(id)); err != nil {
+				return err
+			}
+		}
+		for _, k := range brokenFiles {
+			if _, err := removeFile(t, fileBucket, k); err != nil {
+				return err
+			}
+		}
+		for k, m := range renamedFiles {
+			m.Id = k
+			b, _ := json.Marshal(m)
+			if err := files.Put([]byte(k), b); err != nil {
+				return err
+			}
+		}
+		for _, k := range staleEntries {
+			if err := dirs.Delete(k); err != nil {
+				return err
+			}
+		}
+		for _, dir := range missingFolders {
+			if err := mkdirAll(t, dir); err != nil {
+				return err
+			}
+		}
+		for k, m := range unlinkedFiles {
+			if err := linkFile(t, m); err != nil {
+				return err
+			}
+			b, _ := json.Marshal(m)
+			if err := files.Put([]byte(k), b); err != nil {
+				return err
+			}
+		}
+		for k, e := range miscounted {
+			b, _ := json.Marshal(e)
+			if err := dedups.Put([]byte(k), b); err != nil {
+				return err
+			}
+		}
+		for k, e := range unused {
+			if err := dedups.Delete([]byte(k)); err != nil {
+				return err
+			}
+			id := []byte(uuid.Must(uuid.NewShort()))
+			if _, err := queueObject(t, id, k, &e.Object); err != nil {
+				return err
+			}
+		}
+		for k, e := range miscountedChunks {
+			b, _ := json.Marshal(e)
+			if err := chunks.Put([]byte(k), b); err != nil {
+				return err
+			}
+		}
+		for k, e := range unusedChunks {
+			if err := chunks.Delete([]byte(k)); err != nil {
+				return err
+			}
+			id := []byte(uuid.Must(uuid.NewShort()))
+			if _, err := queueObject(t, id, k, &e.Object); err != nil {
+				return err
+			}
+		}
+		for _, k := range staleTemps {
+			if err := temps.Delete(k); err != nil {
+				return err
+			}
+		}
+		for _, k := range staleUploads {
+			if err := uploads.Delete(k); err != nil {
+				return err
+			}
+			if err := os.Remove(uploadPath(string(k))); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("cannot repair void.db: %v", err)
+	}
+
+	ctx := context.Background()
+	for _, b := range st.backends {
+		l, ok := b.Backend.(store.Lister)
+		if !ok {
+			log.Printf("%s: orphan detection is unavailable, the backend cannot list its objects; orphaned objects in it are not checked\n", b.Name)
+			continue
+		}
+		objs, err := l.List(ctx)
+		if err != nil {
+			report("%s: cannot list objects: %v", b.Name, err)
+			continue
+		}
+		for _, o := range objs {
+			// Uploads from the command line are only recorded once
+			// they are finished.
+			if refs[store.Replica{Backend: b.Name, UploadId: o.UploadId}] ||
+				time.Since(o.ModTime) < tempExpiry {
+				continue
+			}
+			report("%s/%s: orphaned object of %d bytes", b.Name, o.UploadId, o.Size)
+			if !repair {
+				continue
+			}
+			if err := b.Delete(ctx, o.UploadId); err != nil {
+				log.Printf("%s/%s: cannot remove: %v\n", b.Name, o.UploadId, err)
+			}
+		}
+	}
+	return problems
+}
+
+// validKey reports whether the given key unwraps to a key of the file
+// encryption.
+func validKey(kr *keyring, key []byte) bool {
+	k, err := kr.unwrap(key)
+	return err == nil && len(k) == chacha20poly1305.KeySize
+}
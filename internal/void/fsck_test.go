@@ -0,0 +1,114 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// fsck runs Fsck on the database of the server, which is closed
+// meanwhile.
+func fsck(s *Server, repair bool) int {
+	s.db.Close()
+	defer func() { s.db = openDB() }()
+	return Fsck(repair)
+}
+
+// orphan uploads an object that no record refers to, and dates it back
+// by the given duration.
+func orphan(t *testing.T, s *Server, age time.Duration) string {
+	t.Helper()
+	key := make([]byte, 32)
+	rand.Read(key)
+	b := s.store.backends[0]
+	id, err := b.Upload(context.Background(), key, bytes.NewReader([]byte("orphan")))
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	mtime := time.Now().Add(-age)
+	if err := os.Chtimes(filepath.Join(Conf.StoreDirs[0], id), mtime, mtime); err != nil {
+		t.Fatalf("date back: %v", err)
+	}
+	return id
+}
+
+// putRecord puts the given record in the given bucket.
+func putRecord(s *Server, bucket, k string, v interface{}) {
+	b, ok := v.([]byte)
+	if !ok {
+		b, _ = json.Marshal(v)
+	}
+	s.db.Update(func(t *bbolt.Tx) error {
+		return t.Bucket([]byte(bucket)).Put([]byte(k), b)
+	})
+}
+
+func TestFsck(t *testing.T) {
+	tests := []struct {
+		name     string
+		seed     func(t *testing.T, s *Server)
+		problems int
+		removes  int // the number of removed objects
+	}{
+		{"healthy", func(t *testing.T, s *Server) {}, 0, 0},
+		{"orphan", func(t *testing.T, s *Server) { orphan(t, s, 2*tempExpiry) }, 1, 1},
+		{"recent upload", func(t *testing.T, s *Server) { orphan(t, s, time.Minute) }, 0, 0},
+		{"invalid record", func(t *testing.T, s *Server) {
+			putRecord(s, fileBucket, "broken", []byte("{"))
+		}, 1, 0},
+		{"missing upload id", func(t *testing.T, s *Server) {
+			putRecord(s, fileBucket, "empty", &Metadata{Id: "empty", FileName: "empty", Path: "/empty"})
+			putRecord(s, dirBucket, "/empty", []byte("empty"))
+		}, 1, 0},
+		{"stale tag", func(t *testing.T, s *Server) {
+			putRecord(s, tagBucket, string(tagKey("gone", "nothing")), []byte("nothing"))
+		}, 1, 0},
+		{"expired reservation", func(t *testing.T, s *Server) {
+			putRecord(s, tempBucket, "late", &Metadata{Id: "late", Expire: time.Now().Add(-time.Hour)})
+		}, 1, 0},
+		{"stale folder entry", func(t *testing.T, s *Server) {
+			putRecord(s, dirBucket, "/gone.txt", []byte("gone"))
+		}, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			data := []byte("hello void")
+			id := postFile(t, s, "a.txt", data)
+			tt.seed(t, s)
+			objs, _ := os.ReadDir(Conf.StoreDirs[0])
+
+			if n := fsck(s, false); n != tt.problems {
+				t.Fatalf("check finds %d problems, want %d", n, tt.problems)
+			}
+			if after, _ := os.ReadDir(Conf.StoreDirs[0]); len(after) != len(objs) {
+				t.Fatalf("check removes objects")
+			}
+			if n := fsck(s, true); n != tt.problems {
+				t.Fatalf("repair finds %d problems, want %d", n, tt.problems)
+			}
+			if after, _ := os.ReadDir(Conf.StoreDirs[0]); len(objs)-len(after) != tt.removes {
+				t.Fatalf("repair removes %d objects, want %d", len(objs)-len(after), tt.removes)
+			}
+			if n := fsck(s, false); n != 0 {
+				t.Fatalf("%d problems remain after the repair", n)
+			}
+
+			w, err := getFile(t, s, nil, "id="+id)
+			if err != nil || !bytes.Equal(w.Body.Bytes(), data) {
+				t.Fatalf("healthy file is lost by the repair: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,300 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"go.etcd.io/bbolt"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// wrappedKeyVersion is the first byte of a wrapped key, which is
+// followed by the nonce and the sealed key. Keys of the plain key size
+// are not wrapped, they are written before a master key was configured.
+const wrappedKeyVersion = 1
+
+// keyring wraps the keys of files under the master key-encryption key,
+// so that the database alone does not decrypt any file. A nil keyring
+// keeps keys as they are.
+type keyring struct {
+	kek cipher.AEAD
+	old []cipher.AEAD // previous master keys that are being rotated
+}
+
+// newKeyring returns a keyring of the given master key and previous
+// master keys, or nil if there is no master key.
+func newKeyring(kek []byte, old ...[]byte) (*keyring, error) {
+	if kek == nil {
+		return nil, nil
+	}
+	kr := &keyring{}
+	var err error
+	kr.kek, err = chacha20poly1305.NewX(kek)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range old {
+		aead, err := chacha20poly1305.NewX(k)
+		if err != nil {
+			return nil, err
+		}
+		kr.old = append(kr.old, aead)
+	}
+	return kr, nil
+}
+
+// loadKEK loads a master key from the environment variable of the
+// given name, or from the file named by the variable with a _FILE
+// suffix. Either contains the base64 encoded key.
+func loadKEK(name string) []byte {
+	v := os.Getenv(name)
+	if p := os.Getenv(name + "_FILE"); v == "" && p != "" {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			log.Fatalf("cannot read %s_FILE: %v", name, err)
+		}
+		v = string(b)
+	}
+	if v = strings.TrimSpace(v); v == "" {
+		return nil
+	}
+	k, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(k) != chacha20poly1305.KeySize {
+		log.Fatalf("%s is not a base64 encoded key of %d bytes", name, chacha20poly1305.KeySize)
+	}
+	return k
+}
+
+func isWrapped(key []byte) bool {
+	return len(key) != chacha20poly1305.KeySize && len(key) > 0 && key[0] == wrappedKeyVersion
+}
+
+// wrap wraps the given key under the master key. Keys that are wrapped
+// already are returned as they are.
+func (kr *keyring) wrap(key []byte) ([]byte, error) {
+	if kr == nil || len(key) == 0 || isWrapped(key) {
+		return key, nil
+	}
+
+	nonce := make([]byte, chacha20poly1305.NonceSizeX, 1+chacha20poly1305.NonceSizeX+len(key)+chacha20poly1305.Overhead)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	wrapped := append([]byte{wrappedKeyVersion}, nonce...)
+	return kr.kek.Seal(wrapped, nonce, key, nil), nil
+}
+
+// unwrap returns the plain key of the given key. Keys that are not
+// wrapped are returned as they are.
+func (kr *keyring) unwrap(key []byte) ([]byte, error) {
+	if !isWrapped(key) {
+		return key, nil
+	}
+	if kr == nil {
+		return nil, errors.New("key is wrapped but no VOID_KEK is configured")
+	}
+	if len(key) < 1+chacha20poly1305.NonceSizeX+chacha20poly1305.Overhead {
+		return nil, errors.New("wrapped key is too short")
+	}
+
+	nonce, sealed := key[1:1+chacha20poly1305.NonceSizeX], key[1+chacha20poly1305.NonceSizeX:]
+	for _, aead := range append([]cipher.AEAD{kr.kek}, kr.old...) {
+		if k, err := aead.Open(nil, nonce, sealed, nil); err == nil {
+			return k, nil
+		}
+	}
+	return nil, errors.New("key is not wrapped by any configured master key")
+}
+
+// sealMeta seals the user metadata of the file of the given id by the
+// master key.
+func (kr *keyring) sealMeta(um *userMeta, id string) ([]byte, error) {
+	if kr == nil {
+		return nil, errors.New("missing VOID_KEK")
+	}
+	return sealMeta(kr.kek, um, []byte(id))
+}
+
+// openMeta opens the user metadata of the file of the given id that was
+// sealed by the current or a previous master key. It reports whether
+// the metadata was sealed by the current master key.
+func (kr *keyring) openMeta(sealed []byte, id string) (um *userMeta, current bool, err error) {
+	if kr == nil {
+		return nil, false, errors.New("metadata is sealed but no VOID_KEK is configured")
+	}
+	for i, aead := range append([]cipher.AEAD{kr.kek}, kr.old...) {
+		if um, err := openMeta(aead, sealed, []byte(id)); err == nil {
+			return um, i == 0, nil
+		}
+	}
+	return nil, false, errors.New("metadata is not sealed by any configured master key")
+}
+
+// wrapObject wraps the keys of the object and its chunks.
+func (kr *keyring) wrapObject(o *Object) (err error) {
+	if o.Key, err = kr.wrap(o.Key); err != nil {
+		return err
+	}
+	for i := range o.Chunks {
+		if err := kr.wrapObject(&o.Chunks[i].Object); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unwrapObject unwraps the keys of the object and its chunks.
+func (kr *keyring) unwrapObject(o *Object) (err error) {
+	if o.Key, err = kr.unwrap(o.Key); err != nil {
+		return err
+	}
+	for i := range o.Chunks {
+		if err := kr.unwrapObject(&o.Chunks[i].Object); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// current reports whether the keys of the object and its chunks are
+// wrapped under the current master key.
+func (kr *keyring) current(o *Object) bool {
+	if len(o.Key) > 0 {
+		if !isWrapped(o.Key) || len(o.Key) < 1+chacha20poly1305.NonceSizeX {
+			return false
+		}
+		nonce, sealed := o.Key[1:1+chacha20poly1305.NonceSizeX], o.Key[1+chacha20poly1305.NonceSizeX:]
+		if _, err := kr.kek.Open(nil, nonce, sealed, nil); err != nil {
+			return false
+		}
+	}
+	for i := range o.Chunks {
+		if !kr.current(&o.Chunks[i].Object) {
+			return false
+		}
+	}
+	return true
+}
+
+// plainView returns a copy of the metadata with unwrapped keys.
+func (m *Metadata) plainView(kr *keyring) (*Metadata, error) {
+	p := *m
+	p.Chunks = append([]Chunk(nil), m.Chunks...)
+	if err := kr.unwrapObject(&p.Object); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Rewrap wraps the keys of all records under the configured master key.
+// Plain keys of records that were written before a master key was
+// configured are wrapped, and keys and sealed metadata of a previous
+// master key in VOID_KEK_OLD are rewrapped, including the metadata of
+// unfinished uploads. It returns the number of rewrapped records.
+//
+// Rewrap works directly on the database file, thus the server must not
+// be running.
+func Rewrap() (n int) {
+	kr, err := newKeyring(Conf.KEK, Conf.OldKEKs...)
+	if err != nil {
+		log.Fatalf("invalid master key: %v", err)
+	}
+	if kr == nil {
+		log.Fatalf("missing VOID_KEK.")
+	}
+
+	db := openDB()
+	defer db.Close()
+
+	// rewrap rewraps the keys of an object unless they are wrapped
+	// under the current master key already.
+	rewrap := func(o *Object) (changed bool, err error) {
+		if kr.current(o) {
+			return false, nil
+		}
+		plain := *o
+		plain.Chunks = append([]Chunk(nil), o.Chunks...)
+		if err := kr.unwrapObject(&plain); err != nil {
+			return false, err
+		}
+		if err := kr.wrapObject(&plain); err != nil {
+			return false, err
+		}
+		*o = plain
+		return true, nil
+	}
+
+	err = db.Update(func(t *bbolt.Tx) error {
+		for _, bucket := range []string{fileBucket, versionBucket, trashBucket, tempBucket, reapBucket, unreapBucket, uploadBucket, dedupBucket, chunkBucket} {
+			b := t.Bucket([]byte(bucket))
+			updates := map[string][]byte{}
+			err := b.ForEach(func(k, v []byte) error {
+				var (
+					rec interface{}
+					o   *Object
+					m   *Metadata
+				)
+				switch bucket {
+				case dedupBucket, chunkBucket:
+					e := &dedupEntry{}
+					rec, o = e, &e.Object
+				case uploadBucket:
+					u := &upload{}
+					rec, o, m = u, &u.Object, &u.Metadata
+				default:
+					m = &Metadata{}
+					rec, o = m, &m.Object
+				}
+				if err := json.Unmarshal(v, rec); err != nil {
+					log.Printf("%s/%s: invalid record, skipped: %v\n", bucket, k, err)
+					return nil
+				}
+				changed, err := rewrap(o)
+				if err != nil {
+					return fmt.Errorf("%s/%s: %w", bucket, k, err)
+				}
+				if m != nil && m.Sealed != nil {
+					um, current, err := kr.openMeta(m.Sealed, m.Id)
+					if err != nil {
+						return fmt.Errorf("%s/%s: %w", bucket, k, err)
+					}
+					if !current {
+						if m.Sealed, err = kr.sealMeta(um, m.Id); err != nil {
+							return err
+						}
+						changed = true
+					}
+				}
+				if changed {
+					updates[string(k)], _ = json.Marshal(rec)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for k, v := range updates {
+				if err := b.Put([]byte(k), v); err != nil {
+					return err
+				}
+			}
+			n += len(updates)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("cannot rewrap keys: %v", err)
+	}
+	return n
+}
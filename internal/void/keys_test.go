@@ -0,0 +1,131 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go.etcd.io/bbolt"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func newKey() []byte {
+	k := make([]byte, chacha20poly1305.KeySize)
+	rand.Read(k)
+	return k
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	k1, k2 := newKey(), newKey()
+	key := newKey()
+	kr1, _ := newKeyring(k1)
+	kr2, _ := newKeyring(k2)
+	rotated, _ := newKeyring(k2, k1)
+
+	tests := []struct {
+		name   string
+		wrap   *keyring
+		unwrap *keyring
+		ok     bool
+	}{
+		{"no master key", nil, nil, true},
+		{"master key", kr1, kr1, true},
+		{"previous master key", kr1, rotated, true},
+		{"other master key", kr1, kr2, false},
+		{"missing master key", kr1, nil, false},
+		{"plain key", nil, kr1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wrapped, err := tt.wrap.wrap(key)
+			if err != nil {
+				t.Fatalf("wrap: %v", err)
+			}
+			if (tt.wrap != nil) == bytes.Equal(wrapped, key) {
+				t.Fatalf("key is wrapped: %v, want %v", !bytes.Equal(wrapped, key), tt.wrap != nil)
+			}
+			if again, _ := tt.wrap.wrap(wrapped); !bytes.Equal(again, wrapped) {
+				t.Fatalf("wrapped key is wrapped again")
+			}
+
+			got, err := tt.unwrap.unwrap(wrapped)
+			if (err == nil) != tt.ok {
+				t.Fatalf("unwrap: %v, want success %v", err, tt.ok)
+			}
+			if tt.ok && !bytes.Equal(got, key) {
+				t.Fatalf("unwrap returns another key")
+			}
+		})
+	}
+}
+
+func TestRewrap(t *testing.T) {
+	s := newTestServer(t)
+	k1, k2 := newKey(), newKey()
+	files := map[string][]byte{}
+	for i := 0; i < 3; i++ {
+		data := []byte("plain file " + strconv.Itoa(i))
+		files[postFile(t, s, "plain"+strconv.Itoa(i), data)] = data
+	}
+
+	// Files of a master key, and an unfinished upload whose name is
+	// sealed.
+	s.store.keys, _ = newKeyring(k1)
+	Conf.SealNames = true
+	for i := 0; i < 3; i++ {
+		data := []byte("wrapped file " + strconv.Itoa(i))
+		files[postFile(t, s, "wrapped"+strconv.Itoa(i), data)] = data
+	}
+	w := tusRequest(s, http.MethodPost, tusPath, nil,
+		"Upload-Length", "10",
+		"Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("a.txt")))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create responds %d", w.Code)
+	}
+	uid := strings.TrimPrefix(w.Header().Get("Location"), tusPath)
+	s.db.Close()
+
+	Conf.KEK = k1
+	if n := Rewrap(); n != 3 {
+		t.Fatalf("wrapping rewraps %d records, want the 3 plain files", n)
+	}
+	Conf.KEK, Conf.OldKEKs = k2, [][]byte{k1}
+	if n := Rewrap(); n != 7 {
+		t.Fatalf("rotation rewraps %d records, want 6 files and the upload", n)
+	}
+	if n := Rewrap(); n != 0 {
+		t.Fatalf("rewrap of current keys rewraps %d records", n)
+	}
+
+	// Every record opens by the new master key alone.
+	s.db = openDB()
+	s.store.keys, _ = newKeyring(k2)
+	for id, data := range files {
+		w, err := getFile(t, s, nil, "id="+id)
+		if err != nil || !bytes.Equal(w.Body.Bytes(), data) {
+			t.Fatalf("get of %s after rewrap: %v", id, err)
+		}
+	}
+	var v []byte
+	s.db.View(func(t *bbolt.Tx) error {
+		v = t.Bucket([]byte(uploadBucket)).Get([]byte(uid))
+		return nil
+	})
+	u := &upload{}
+	if err := json.Unmarshal(v, u); err != nil || u.Sealed == nil {
+		t.Fatalf("upload is not sealed: %v", err)
+	}
+	um, current, err := s.store.keys.openMeta(u.Sealed, u.Id)
+	if err != nil || !current || um.FileName != "a.txt" {
+		t.Fatalf("upload opens as %+v, current %v: %v", um, current, err)
+	}
+}
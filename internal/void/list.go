@@ -0,0 +1,357 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// The sort orders of a file list. Files are sorted by their ids unless
+// another order is requested, and files of the same sort key are
+// sorted by their ids as well.
+const (
+	SortName    = "name"
+	SortSize    = "size"
+	SortCreated = "created_at"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// ListOptions filter, sort and paginate a file list. The zero options
+// list the first page of all files.
+type ListOptions struct {
+	Tags    []string  // files that have all the tags
+	Search  string    // files whose name contains the text, ignoring case
+	Glob    string    // files whose name matches the pattern
+	Type    string    // files of the content type, eg. "image/png" or "image/*"
+	MinSize int64     // files of at least the bytes
+	MaxSize int64     // files of at most the bytes, or 0 for no limit
+	After   time.Time // files that were created at or after the time
+	Before  time.Time // files that were created before the time
+
+	Sort   string // one of SortName, SortSize and SortCreated, or empty for ids
+	Desc   bool   // sort in descending order
+	Limit  int    // files of a page, or 0 for the default
+	Cursor string // the page after the cursor of the previous page
+}
+
+// Query returns the options as the query parameters of a file list.
+func (o *ListOptions) Query() url.Values {
+	q := url.Values{}
+	q["tag"] = o.Tags
+	set := func(k, v string, ok bool) {
+		if ok {
+			q.Set(k, v)
+		}
+	}
+	set("q", o.Search, o.Search != "")
+	set("name", o.Glob, o.Glob != "")
+	set("type", o.Type, o.Type != "")
+	set("min_size", strconv.FormatInt(o.MinSize, 10), o.MinSize > 0)
+	set("max_size", strconv.FormatInt(o.MaxSize, 10), o.MaxSize > 0)
+	set("after", o.After.Format(time.RFC3339Nano), !o.After.IsZero())
+	set("before", o.Before.Format(time.RFC3339Nano), !o.Before.IsZero())
+	set("sort", o.Sort, o.Sort != "")
+	set("order", "desc", o.Desc)
+	set("limit", strconv.Itoa(o.Limit), o.Limit > 0)
+	set("cursor", o.Cursor, o.Cursor != "")
+	return q
+}
+
+// ParseTime parses a time of RFC 3339 or a date of the form
+// "2006-01-02" in UTC.
+func ParseTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
+
+// parseListOptions parses the options of a file list from the given
+// query parameters.
+func parseListOptions(q url.Values) (o *ListOptions, err error) {
+	o = &ListOptions{
+		Search: q.Get("q"),
+		Glob:   q.Get("name"),
+		Type:   q.Get("type"),
+		Sort:   q.Get("sort"),
+		Cursor: q.Get("cursor"),
+	}
+	o.Tags, err = cleanTags(q["tag"])
+	if err != nil {
+		return nil, err
+	}
+	if _, err = path.Match(o.Glob, ""); err != nil {
+		return nil, fmt.Errorf("invalid name pattern %q", o.Glob)
+	}
+
+	ints := []struct {
+		name string
+		v    *int64
+	}{{"min_size", &o.MinSize}, {"max_size", &o.MaxSize}}
+	for _, i := range ints {
+		if v := q.Get(i.name); v != "" {
+			*i.v, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || *i.v < 0 {
+				return nil, fmt.Errorf("%s is not a number of bytes, got %s", i.name, v)
+			}
+		}
+	}
+	times := []struct {
+		name string
+		v    *time.Time
+	}{{"after", &o.After}, {"before", &o.Before}}
+	for _, t := range times {
+		if v := q.Get(t.name); v != "" {
+			*t.v, err = ParseTime(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s is neither a date nor a time of RFC 3339, got %s", t.name, v)
+			}
+		}
+	}
+
+	switch o.Sort {
+	case "", SortName, SortSize, SortCreated:
+	default:
+		return nil, fmt.Errorf("sort is none of %q, %q and %q, got %s", SortName, SortSize, SortCreated, o.Sort)
+	}
+	switch order := q.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		o.Desc = true
+	default:
+		return nil, fmt.Errorf("order is neither %q nor %q, got %s", "asc", "desc", order)
+	}
+	if v := q.Get("limit"); v != "" {
+		o.Limit, err = strconv.Atoi(v)
+		if err != nil || o.Limit <= 0 {
+			return nil, fmt.Errorf("limit is not a positive number, got %s", v)
+		}
+	}
+	if o.Limit == 0 {
+		o.Limit = defaultListLimit
+	} else if o.Limit > maxListLimit {
+		o.Limit = maxListLimit
+	}
+	if _, err = o.cursor(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// contentType returns the content type of the given file regards the
+// extension of its name.
+func contentType(m *Metadata) string {
+	t, _, err := mime.ParseMediaType(mime.TypeByExtension(path.Ext(m.FileName)))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return t
+}
+
+// match reports whether the given file passes the filters.
+func (o *ListOptions) match(m *Metadata) bool {
+	switch {
+	case !hasTags(m, o.Tags):
+		return false
+	case o.Search != "" && !strings.Contains(strings.ToLower(m.FileName), strings.ToLower(o.Search)):
+		return false
+	case m.FileSize < o.MinSize, o.MaxSize > 0 && m.FileSize > o.MaxSize:
+		return false
+	case m.CreatedAt.Before(o.After), !o.Before.IsZero() && !m.CreatedAt.Before(o.Before):
+		return false
+	}
+	if o.Glob != "" {
+		if ok, _ := path.Match(o.Glob, m.FileName); !ok {
+			return false
+		}
+	}
+	if o.Type != "" {
+		t := contentType(m)
+		if prefix := strings.TrimSuffix(o.Type, "*"); prefix != o.Type {
+			return strings.HasPrefix(t, prefix)
+		}
+		return t == o.Type
+	}
+	return true
+}
+
+// listCursor is the position in a sorted list, the sort key and the id
+// of the last file of a page.
+type listCursor struct {
+	Key string `json:"k"`
+	Id  string `json:"id"`
+}
+
+// cursor returns the decoded cursor of the options, or nil if the list
+// starts from the beginning.
+func (o *ListOptions) cursor() (*listCursor, error) {
+	if o.Cursor == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(o.Cursor)
+	c := &listCursor{}
+	if err == nil {
+		err = json.Unmarshal(b, c)
+	}
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	return c, nil
+}
+
+// key returns the sort key of the given file, which sorts as strings.
+func (o *ListOptions) key(m *Metadata) string {
+	switch o.Sort {
+	case SortName:
+		return strings.ToLower(m.FileName)
+	case SortSize:
+		return fmt.Sprintf("%020d", m.FileSize)
+	case SortCreated:
+		return m.CreatedAt.UTC().Format("2006-01-02T15:04:05.000000000")
+	}
+	return ""
+}
+
+// before reports whether the position of a is before b in the list.
+func (o *ListOptions) before(a, b *listCursor) bool {
+	less := a.Key < b.Key || (a.Key == b.Key && a.Id < b.Id)
+	if o.Desc {
+		return !less && *a != *b
+	}
+	return less
+}
+
+// encode returns the cursor of the list after the given position.
+func (c *listCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// page sorts the given files, which passed the filters already, and
+// returns the page of the options and the cursor of the next page, or
+// an empty cursor if it is the last page. The cursor was validated by
+// parseListOptions.
+func (o *ListOptions) page(files []*Metadata) (page []*Metadata, next string) {
+	pos := func(m *Metadata) *listCursor { return &listCursor{Key: o.key(m), Id: m.Id} }
+	sort.Slice(files, func(i, j int) bool { return o.before(pos(files[i]), pos(files[j])) })
+	if after, _ := o.cursor(); after != nil {
+		i := sort.Search(len(files), func(i int) bool { return o.before(after, pos(files[i])) })
+		files = files[i:]
+	}
+	if len(files) > o.Limit {
+		return files[:o.Limit], pos(files[o.Limit-1]).encode()
+	}
+	return files, ""
+}
+
+// listFiles returns the page of files of the given options, and the
+// cursor of the next page, or an empty cursor if it is the last page.
+// Only the files of a page are kept in memory, and the files that are
+// sorted by ids are read until the page is complete. Other orders have
+// no index, thus all files are read to find a page of them, which is a
+// known limitation for large databases.
+func (s *Server) listFiles(r *http.Request, o *ListOptions) (files []*Metadata, next string, err error) {
+	after, err := o.cursor()
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The page has one more file to tell if there is a next page, and
+	// the files are inserted in their order.
+	var keys []*listCursor
+	add := func(m *Metadata) (full bool) {
+		m = s.nameView(r, m.publicView())
+		if !o.match(m) {
+			return false
+		}
+		k := &listCursor{Key: o.key(m), Id: m.Id}
+		if after != nil && !o.before(after, k) {
+			return false
+		}
+		i := sort.Search(len(keys), func(i int) bool { return o.before(k, keys[i]) })
+		if i > o.Limit {
+			return false
+		}
+		keys = append(keys[:i], append([]*listCursor{k}, keys[i:]...)...)
+		files = append(files[:i], append([]*Metadata{m}, files[i:]...)...)
+		if len(files) > o.Limit+1 {
+			keys, files = keys[:o.Limit+1], files[:o.Limit+1]
+		}
+		return o.Sort == "" && len(files) > o.Limit
+	}
+
+	err = s.db.View(func(t *bbolt.Tx) error {
+		b := t.Bucket([]byte(fileBucket))
+		load := func(v []byte) (full bool) {
+			m := &Metadata{}
+			if err := json.Unmarshal(v, m); err != nil {
+				return false // reported by fsck
+			}
+			return add(m)
+		}
+
+		if len(o.Tags) > 0 {
+			ids := taggedFiles(t, o.Tags)
+			if o.Desc {
+				sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+			}
+			for _, id := range ids {
+				if load(b.Get([]byte(id))) {
+					break
+				}
+			}
+			return nil
+		}
+
+		c := b.Cursor()
+		switch {
+		case o.Sort != "" || after == nil:
+			if !o.Desc {
+				for k, v := c.First(); k != nil && !load(v); k, v = c.Next() {
+				}
+			} else {
+				for k, v := c.Last(); k != nil && !load(v); k, v = c.Prev() {
+				}
+			}
+		case !o.Desc:
+			for k, v := c.Seek([]byte(after.Id)); k != nil && !load(v); k, v = c.Next() {
+			}
+		default:
+			k, v := c.Seek([]byte(after.Id))
+			if k == nil {
+				k, v = c.Last()
+			}
+			for ; k != nil && !load(v); k, v = c.Prev() {
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(files) > o.Limit {
+		next = keys[o.Limit-1].encode()
+		files = files[:o.Limit]
+	}
+	return files, next, nil
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"changkun.de/x/void/internal/store"
+	"go.etcd.io/bbolt"
+)
+
+// reapInterval is the interval of retrying the removal of the contents
+// of deleted files.
+const reapInterval = 10 * time.Minute
+
+// removeFile removes the record of a file from the given bucket within
+// the transaction. Its object is queued in the reap bucket to be removed
+// from the backends later on, unless other files still share it, and
+// the file is removed from the tree of folders and the tag index. The
+// previous versions of the file are removed as well. It returns the ids
+// of the queued objects.
+func removeFile(t *bbolt.Tx, bucket string, id []byte) (queued [][]byte, err error) {
+	b := t.Bucket([]byte(bucket))
+	v := b.Get(id)
+	if v == nil {
+		return nil, errors.New("id does not exist")
+	}
+
+	m := &Metadata{}
+	if err := json.Unmarshal(v, m); err != nil {
+		// Keep the record as it is, the reaper reports it.
+		err = t.Bucket([]byte(reapBucket)).Put(id, v)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{id}, b.Delete(id)
+	}
+
+	if err := unindexFile(t, m); err != nil {
+		return nil, err
+	}
+	unused, err := releaseObject(t, m)
+	if err != nil {
+		return nil, err
+	}
+	if unused {
+		queued, err = queueObject(t, id, m.FileName, &m.Object)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if bucket == fileBucket || bucket == trashBucket {
+		q, err := removeVersions(t, m.Id)
+		if err != nil {
+			return nil, err
+		}
+		queued = append(queued, q...)
+	}
+	return queued, b.Delete(id)
+}
+
+// queueObject queues an object under the given id in the reap bucket
+// within the transaction. A chunked object releases its chunks instead,
+// and the chunks that are no longer used are queued under derived ids.
+// It returns the ids of the queued objects.
+func queueObject(t *bbolt.Tx, id []byte, name string, o *Object) (queued [][]byte, err error) {
+	if !o.chunked() {
+		b, _ := json.Marshal(&Metadata{Id: string(id), Object: *o, FileName: name})
+		return [][]byte{id}, t.Bucket([]byte(reapBucket)).Put(id, b)
+	}
+
+	unused, err := releaseChunks(t, o)
+	if err != nil {
+		return nil, err
+	}
+	for i := range unused {
+		cid := []byte(fmt.Sprintf("%s.%d", id, i))
+		q, err := queueObject(t, cid, name, &unused[i])
+		if err != nil {
+			return nil, err
+		}
+		queued = append(queued, q...)
+	}
+	return queued, nil
+}
+
+// objectInUse reports whether the given object is shared by files again
+// after it was queued, in which case it must not be removed.
+func objectInUse(t *bbolt.Tx, o *Object) bool {
+	for _, bucket := range []string{dedupBucket, chunkBucket} {
+		e, err := lookupObject(t, bucket, o.Sha256)
+		if err == nil && e != nil && e.UploadId == o.UploadId {
+			return true
+		}
+	}
+	return false
+}
+
+// reap tries to remove the content of a queued file from the backends.
+// The file stays in the queue to retry in a later attempt if the removal
+// fails. If the backend cannot remove the content at all, the file is
+// reported once and moved to the unreap bucket, so that the content is
+// not forgotten but not retried either.
+func (s *Server) reap(ctx context.Context, id []byte) {
+	var v []byte
+	s.db.View(func(t *bbolt.Tx) error {
+		v = t.Bucket([]byte(reapBucket)).Get(id)
+		return nil
+	})
+	if v == nil {
+		return
+	}
+
+	m := &Metadata{}
+	inUse := false
+	err := json.Unmarshal(v, m)
+	if err == nil {
+		s.db.View(func(t *bbolt.Tx) error {
+			inUse = objectInUse(t, &m.Object)
+			return nil
+		})
+		if !inUse {
+			err = s.store.Remove(ctx, &m.Object)
+		}
+	}
+	switch {
+	case inUse:
+		log.Printf("item %s is in use again, skip reaping.\n", id)
+	case err == nil:
+		log.Printf("item %s was reaped.\n", id)
+	case errors.Is(err, store.ErrNotSupported):
+		log.Printf("item %s cannot be reaped by the backend, its content stays in the backend: %v\n", id, err)
+		s.db.Update(func(t *bbolt.Tx) error {
+			if err := t.Bucket([]byte(unreapBucket)).Put(id, v); err != nil {
+				return err
+			}
+			return t.Bucket([]byte(reapBucket)).Delete(id)
+		})
+		return
+	default:
+		log.Printf("item %s failed to reap, will retry: %v\n", id, err)
+		return
+	}
+
+	s.db.Update(func(t *bbolt.Tx) error {
+		return t.Bucket([]byte(reapBucket)).Delete(id)
+	})
+}
+
+// reapDeleted periodically retries to remove the contents of deleted
+// files from the backends. Contents in the unreap bucket are skipped.
+func (s *Server) reapDeleted() {
+	go func() {
+		t := time.NewTicker(reapInterval)
+		for range t.C {
+			var ids [][]byte
+			s.db.View(func(t *bbolt.Tx) error {
+				return t.Bucket([]byte(reapBucket)).ForEach(func(k, v []byte) error {
+					ids = append(ids, append([]byte(nil), k...))
+					return nil
+				})
+			})
+			for _, id := range ids {
+				s.reap(context.Background(), id)
+			}
+		}
+	}()
+}
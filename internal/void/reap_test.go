@@ -0,0 +1,82 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"changkun.de/x/void/internal/store"
+	"go.etcd.io/bbolt"
+)
+
+// failingDelete is a backend whose deletes fail by the given error.
+type failingDelete struct {
+	store.Backend
+	err     error
+	deletes int
+}
+
+func (b *failingDelete) Delete(ctx context.Context, id string) error {
+	b.deletes++
+	if b.err != nil {
+		return b.err
+	}
+	return b.Backend.Delete(ctx, id)
+}
+
+func TestReap(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		bucket string // the bucket that keeps the item
+	}{
+		{"reaped", nil, ""},
+		{"failed", errors.New("network is down"), reapBucket},
+		{"unsupported", store.ErrNotSupported, unreapBucket},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			l, err := store.NewLocal(t.TempDir())
+			if err != nil {
+				t.Fatalf("new local: %v", err)
+			}
+			b := &failingDelete{Backend: l, err: tt.err}
+			s.store = newStorage(store.Replicated{{Name: "local", Backend: b}}, 0, 0)
+
+			id := postFile(t, s, "a.txt", []byte("hello void"))
+			req := httptest.NewRequest(http.MethodDelete, "/void?id="+id, nil)
+			if err := s.handleDelete(httptest.NewRecorder(), req); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+
+			// The reaper retries the queue, an unsupported delete is
+			// not retried.
+			s.reap(context.Background(), []byte(id))
+			want := 2
+			if tt.bucket != reapBucket {
+				want = 1
+			}
+			if b.deletes != want {
+				t.Fatalf("backend deletes %d times, want %d", b.deletes, want)
+			}
+
+			for _, bucket := range []string{reapBucket, unreapBucket} {
+				var kept bool
+				s.db.View(func(t *bbolt.Tx) error {
+					kept = t.Bucket([]byte(bucket)).Get([]byte(id)) != nil
+					return nil
+				})
+				if kept != (bucket == tt.bucket) {
+					t.Fatalf("%s keeps the item: %v", bucket, kept)
+				}
+			}
+		})
+	}
+}
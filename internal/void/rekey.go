@@ -0,0 +1,141 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"changkun.de/x/void/internal/uuid"
+	"go.etcd.io/bbolt"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Rekey re-encrypts the contents of the given files by new keys, and
+// returns the number of files that were rekeyed. The old objects are
+// removed from the backends as far as the backends support it.
+//
+// Rekey works directly on the database file, thus the server must not
+// be running.
+func Rekey(ids []string) (n int) {
+	s := newServer(openDB(), NewStorage())
+	defer s.db.Close()
+
+	for _, id := range ids {
+		if err := s.rekey(context.Background(), id); err != nil {
+			log.Printf("%s: cannot rekey: %v\n", id, err)
+			continue
+		}
+		log.Printf("%s: rekeyed.\n", id)
+		n++
+	}
+	return n
+}
+
+// rekey uploads the content of a file again under a new key, and swaps
+// the object of the file and of every file that shares it in a single
+// transaction. The content of a chunked file is uploaded as a whole,
+// because its chunks are shared by other files of other contents. The
+// content of a file that the client encrypted stays encrypted by the
+// key of the client.
+func (s *Server) rekey(ctx context.Context, id string) error {
+	var v []byte
+	s.db.View(func(t *bbolt.Tx) error {
+		v = t.Bucket([]byte(fileBucket)).Get([]byte(id))
+		return nil
+	})
+	if v == nil {
+		return errors.New("id does not exist")
+	}
+	m := &Metadata{}
+	if err := json.Unmarshal(v, m); err != nil {
+		return err
+	}
+	old := m.Object
+
+	f, err := s.store.Open(ctx, &old)
+	if err != nil {
+		return fmt.Errorf("cannot open the object: %w", err)
+	}
+	defer f.Close()
+
+	o := &Object{}
+	o.Key, err = allocKey(chacha20poly1305.KeySize)
+	if err != nil {
+		return err
+	}
+	if err := s.store.Put(ctx, o, f); err != nil {
+		return fmt.Errorf("cannot upload the object: %w", err)
+	}
+	if err := s.store.keys.wrapObject(o); err != nil {
+		return err
+	}
+
+	var queued [][]byte
+	err = s.db.Update(func(t *bbolt.Tx) error {
+		if old.Sha256 != "" && o.Sha256 != old.Sha256 {
+			return fmt.Errorf("content does not match its checksum, expect %s, got %s", old.Sha256, o.Sha256)
+		}
+
+		// The object is swapped in every file, previous version and
+		// deleted file that shares it.
+		for _, bucket := range []string{fileBucket, versionBucket, trashBucket} {
+			b := t.Bucket([]byte(bucket))
+			swapped := map[string][]byte{}
+			err := b.ForEach(func(k, v []byte) error {
+				fm := &Metadata{}
+				if err := json.Unmarshal(v, fm); err != nil || fm.UploadId != old.UploadId {
+					return nil
+				}
+				fm.Object = *o
+				swapped[string(k)], _ = json.Marshal(fm)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if bucket == fileBucket && swapped[id] == nil {
+				return errors.New("file was changed meanwhile")
+			}
+			for k, v := range swapped {
+				if err := b.Put([]byte(k), v); err != nil {
+					return err
+				}
+			}
+		}
+
+		e, err := lookupObject(t, dedupBucket, old.Sha256)
+		if err != nil {
+			return err
+		}
+		if e != nil && e.UploadId == old.UploadId {
+			e.Object = *o
+			b, _ := json.Marshal(e)
+			if err := t.Bucket([]byte(dedupBucket)).Put([]byte(old.Sha256), b); err != nil {
+				return err
+			}
+		}
+
+		queued, err = queueObject(t, []byte(uuid.Must(uuid.NewShort())), m.FileName, &old)
+		return err
+	})
+	if err != nil {
+		// Nothing refers to the new object, remove it again.
+		cerr := s.db.Update(func(t *bbolt.Tx) (err error) {
+			queued, err = queueObject(t, []byte(uuid.Must(uuid.NewShort())), m.FileName, o)
+			return
+		})
+		if cerr != nil {
+			log.Printf("%s: cannot remove the new object %s: %v\n", id, o.UploadId, cerr)
+		}
+	}
+	for _, id := range queued {
+		s.reap(ctx, id)
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+// rekey runs Rekey on the database of the server, which is closed
+// meanwhile.
+func rekey(s *Server, ids ...string) int {
+	s.db.Close()
+	defer func() { s.db = openDB() }()
+	return Rekey(ids)
+}
+
+func TestRekey(t *testing.T) {
+	s := newTestServer(t)
+	Conf.Dedup, Conf.Versioning, Conf.TrashDays = true, true, defaultTrashDays
+
+	// The object is shared by a file, its previous version, a deleted
+	// file and the dedup index.
+	data := []byte("hello void")
+	id := postFile(t, s, "a.txt", data)
+	if again := postFile(t, s, "a.txt", data); again != id {
+		t.Fatalf("upload to the same path is file %s, want a version of %s", again, id)
+	}
+	deleted := postFile(t, s, "b.txt", data)
+	req := httptest.NewRequest(http.MethodDelete, "/void?id="+deleted, nil)
+	if err := s.handleDelete(httptest.NewRecorder(), req); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	// records returns the objects of the records that share the object.
+	records := func() (objs []Object) {
+		s.db.View(func(t *bbolt.Tx) error {
+			for _, r := range []struct{ bucket, k string }{
+				{fileBucket, id},
+				{versionBucket, string(versionKey(id, 1))},
+				{trashBucket, deleted},
+			} {
+				m := &Metadata{}
+				json.Unmarshal(t.Bucket([]byte(r.bucket)).Get([]byte(r.k)), m)
+				objs = append(objs, m.Object)
+			}
+			e, _ := lookupObject(t, dedupBucket, objs[0].Sha256)
+			if e != nil {
+				objs = append(objs, e.Object)
+			}
+			return nil
+		})
+		return objs
+	}
+	old := records()
+	if len(old) != 4 {
+		t.Fatalf("dedup index misses the object")
+	}
+	for _, o := range old {
+		if o.UploadId != old[0].UploadId {
+			t.Fatalf("records do not share the object: %v", old)
+		}
+	}
+
+	if n := rekey(s, id); n != 1 {
+		t.Fatalf("rekey rekeys %d files, want 1", n)
+	}
+	objs := records()
+	for i, o := range objs {
+		if o.UploadId == old[i].UploadId || bytes.Equal(o.Key, old[i].Key) {
+			t.Fatalf("record %d keeps the old object", i)
+		}
+		if o.UploadId != objs[0].UploadId || !bytes.Equal(o.Key, objs[0].Key) {
+			t.Fatalf("records do not share the new object: %v", objs)
+		}
+	}
+
+	// The old object is queued and removed from the backend.
+	if _, err := os.Stat(filepath.Join(Conf.StoreDirs[0], old[0].UploadId)); !os.IsNotExist(err) {
+		t.Fatalf("old object is kept: %v", err)
+	}
+	var queued int
+	s.db.View(func(t *bbolt.Tx) error {
+		queued = t.Bucket([]byte(reapBucket)).Stats().KeyN
+		return nil
+	})
+	if queued != 0 {
+		t.Fatalf("reap queue keeps %d objects", queued)
+	}
+	for _, q := range []string{"id=" + id, "id=" + id + "&version=1"} {
+		w, err := getFile(t, s, nil, q)
+		if err != nil || !bytes.Equal(w.Body.Bytes(), data) {
+			t.Fatalf("get %s responds %q: %v", q, w.Body, err)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// scopeDirect is the scope of clients that access the backends
+// directly, which requires the keys of the files. Only the users in
+// VOID_DIRECT_USERS are granted this scope, everyone else sees the
+// metadata without any key material.
+const scopeDirect = "direct"
+
+// errNoDirectScope is returned if a request asks for the direct scope
+// but its user is not granted.
+var errNoDirectScope = errors.New("the direct scope is not granted, use the proxy mode instead")
+
+// EncryptedName is the placeholder of file names that are sealed and
+// cannot be opened by the user.
+const EncryptedName = "(encrypted)"
+
+// userKey is the context key of the authenticated user of a request.
+type userKey struct{}
+
+func withUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+func userOf(r *http.Request) string {
+	user, _ := r.Context().Value(userKey{}).(string)
+	return user
+}
+
+// metaScope reports whether the user of the request may see the user
+// metadata that is sealed by the master key. Every user may see it
+// unless VOID_META_USERS is configured.
+func metaScope(r *http.Request) bool {
+	if len(Conf.MetaUsers) == 0 {
+		return true
+	}
+	user := userOf(r)
+	for _, u := range Conf.MetaUsers {
+		if user != "" && u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// sealName seals the file name and the attributes of the metadata by
+// the master key if names are sealed. The size is not sealed, as the
+// server serves the content by it and the backends reveal it anyway. A
+// file name that the client sealed by the key of the file is never
+// stored in plaintext.
+func (s *Server) sealName(m *Metadata) (err error) {
+	if m.E2E != nil && m.E2E.Sealed != nil {
+		m.FileName = ""
+		return nil
+	}
+	if !Conf.SealNames || m.Sealed != nil {
+		return nil
+	}
+	m.Sealed, err = s.store.keys.sealMeta(&userMeta{FileName: m.FileName, Attrs: m.Attrs}, m.Id)
+	if err != nil {
+		return err
+	}
+	m.FileName, m.Attrs = "", nil
+	return nil
+}
+
+// nameView returns a copy of the metadata with the file name and the
+// attributes that are unsealed for users in the metadata scope, or with
+// a placeholder name and without the attributes otherwise. File names
+// that the client sealed can only be opened by the client.
+func (s *Server) nameView(r *http.Request, m *Metadata) *Metadata {
+	if m.Sealed == nil && (m.E2E == nil || m.E2E.Sealed == nil) {
+		return m
+	}
+	p := *m
+	p.Sealed = nil
+	p.FileName = EncryptedName
+	if m.Sealed == nil {
+		return &p
+	}
+	p.Attrs = nil
+	if metaScope(r) {
+		um, _, err := s.store.keys.openMeta(m.Sealed, m.Id)
+		if err == nil {
+			p.FileName, p.Attrs = um.FileName, sealedAttrs(m, um)
+		}
+	}
+	return &p
+}
+
+// sealedAttrs returns the attributes of the given file whose metadata
+// is sealed. Files that were sealed before the attributes were sealed
+// keep them in plaintext.
+func sealedAttrs(m *Metadata, um *userMeta) map[string]string {
+	attrs := map[string]string{}
+	for k, v := range m.Attrs {
+		attrs[k] = v
+	}
+	for k, v := range um.Attrs {
+		attrs[k] = v
+	}
+	attrs, _ = cleanAttrs(attrs)
+	return attrs
+}
+
+// directScope reports whether the request asks for the direct scope. It
+// returns an error if the user of the request is not granted.
+func directScope(r *http.Request) (bool, error) {
+	if r.URL.Query().Get("scope") != scopeDirect {
+		return false, nil
+	}
+	user := userOf(r)
+	for _, u := range Conf.DirectUsers {
+		if user != "" && u == user {
+			return true, nil
+		}
+	}
+	return false, errNoDirectScope
+}
+
+// publicView returns a copy of the metadata without key material.
+func (m *Metadata) publicView() *Metadata {
+	p := *m
+	p.Key = nil
+	if m.Chunks != nil {
+		p.Chunks = make([]Chunk, len(m.Chunks))
+		for i, c := range m.Chunks {
+			c.Key = nil
+			p.Chunks[i] = c
+		}
+	}
+	return &p
+}
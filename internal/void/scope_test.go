@@ -0,0 +1,85 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+func TestSealedMeta(t *testing.T) {
+	s := newTestServer(t)
+	s.store.keys, _ = newKeyring(newKey())
+	Conf.SealNames = true
+	Conf.MetaUsers = []string{"alice"}
+	data := []byte("hello void")
+	id := postFile(t, s, "secret-report.txt", data, "attr", "project=apollo")
+
+	// The record reveals neither the name, nor the attributes.
+	var v []byte
+	s.db.View(func(t *bbolt.Tx) error {
+		v = t.Bucket([]byte(fileBucket)).Get([]byte(id))
+		return nil
+	})
+	for _, secret := range []string{"secret-report", "project", "apollo"} {
+		if bytes.Contains(v, []byte(secret)) {
+			t.Fatalf("record reveals %q: %s", secret, v)
+		}
+	}
+
+	anonymous := httptest.NewRequest(http.MethodGet, "/void", nil)
+	alice := anonymous.WithContext(withUser(anonymous.Context(), "alice"))
+	bob := anonymous.WithContext(withUser(anonymous.Context(), "bob"))
+	tests := []struct {
+		name  string
+		r     *http.Request
+		file  string
+		size  int64
+		attrs map[string]string
+	}{
+		{"meta user", alice, "secret-report.txt", int64(len(data)), map[string]string{"project": "apollo"}},
+		{"other user", bob, EncryptedName, int64(len(data)), nil},
+		{"anonymous", anonymous, EncryptedName, int64(len(data)), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := metadata(t, s, tt.r, id)
+			if m.FileName != tt.file || m.FileSize != tt.size || len(m.Attrs) != len(tt.attrs) {
+				t.Fatalf("metadata is %s, size %d, attrs %v", m.FileName, m.FileSize, m.Attrs)
+			}
+			for k, v := range tt.attrs {
+				if m.Attrs[k] != v {
+					t.Fatalf("attrs are %v, want %v", m.Attrs, tt.attrs)
+				}
+			}
+
+			// The content is served to everyone.
+			w, err := getFile(t, s, tt.r, "id="+id)
+			if err != nil || !bytes.Equal(w.Body.Bytes(), data) {
+				t.Fatalf("get responds %q: %v", w.Body, err)
+			}
+		})
+	}
+
+	// Attributes are edited within the seal.
+	if _, err := s.patchFile(id, &Patch{Attrs: map[string]string{"project": "", "stage": "draft"}}); err != nil {
+		t.Fatalf("patch: %v", err)
+	}
+	s.db.View(func(t *bbolt.Tx) error {
+		v = t.Bucket([]byte(fileBucket)).Get([]byte(id))
+		return nil
+	})
+	if bytes.Contains(v, []byte("stage")) || bytes.Contains(v, []byte("draft")) {
+		t.Fatalf("record reveals the patched attributes: %s", v)
+	}
+	m := metadata(t, s, alice, id)
+	if len(m.Attrs) != 1 || m.Attrs["stage"] != "draft" {
+		t.Fatalf("patched attrs are %v", m.Attrs)
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// scrubInterval is the interval between two scrubs of all files.
+	scrubInterval = 24 * time.Hour
+	// scrubSamples is the number of random ranges that are read from
+	// each object in the sample mode.
+	scrubSamples = 8
+	// scrubSampleSize is the size of each sampled range.
+	scrubSampleSize = 64 << 10
+)
+
+const (
+	scrubOff    = "off"
+	scrubSample = "sample"
+	scrubFull   = "full"
+)
+
+// ScrubResult is the result of checking the integrity of a file.
+type ScrubResult struct {
+	Id        string    `json:"id"`
+	FileName  string    `json:"filename"`
+	CheckedAt time.Time `json:"checked_at"`
+	Healthy   bool      `json:"healthy"`
+	Problems  []string  `json:"problems,omitempty"`
+}
+
+// scrubFiles checks whether the contents of all files are still intact
+// in the backends on start and periodically afterwards, so that a lost
+// or corrupted object is known while it can still be uploaded again.
+func (s *Server) scrubFiles() {
+	if Conf.Scrub == scrubOff {
+		return
+	}
+
+	go func() {
+		t := time.NewTicker(scrubInterval)
+		for ; ; <-t.C {
+			s.scrubAll(context.Background())
+		}
+	}()
+}
+
+// scrubAll checks all files and records the results.
+func (s *Server) scrubAll(ctx context.Context) {
+	var files []*Metadata
+	s.db.View(func(t *bbolt.Tx) error {
+		return t.Bucket([]byte(fileBucket)).ForEach(func(k, v []byte) error {
+			m := &Metadata{}
+			if err := json.Unmarshal(v, m); err == nil {
+				files = append(files, m)
+			}
+			return nil
+		})
+	})
+
+	for _, m := range files {
+		r := s.scrub(ctx, m, Conf.Scrub == scrubFull)
+		if !r.Healthy {
+			log.Printf("item %s is unhealthy: %v\n", m.Id, r.Problems)
+		}
+		b, _ := json.Marshal(r)
+		s.db.Update(func(t *bbolt.Tx) error {
+			// The file might have been deleted meanwhile.
+			if t.Bucket([]byte(fileBucket)).Get([]byte(m.Id)) == nil {
+				return nil
+			}
+			return t.Bucket([]byte(scrubBucket)).Put([]byte(m.Id), b)
+		})
+	}
+
+	// Forget about the results of deleted files.
+	s.db.Update(func(t *bbolt.Tx) error {
+		files := t.Bucket([]byte(fileBucket))
+		b := t.Bucket([]byte(scrubBucket))
+		var gone [][]byte
+		b.ForEach(func(k, v []byte) error {
+			if files.Get(k) == nil {
+				gone = append(gone, k)
+			}
+			return nil
+		})
+		for _, k := range gone {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// scrub checks every object that stores the content of the given file.
+// In the full mode, objects are read completely, otherwise only a few
+// random ranges and the end of them are read.
+func (s *Server) scrub(ctx context.Context, m *Metadata, full bool) *ScrubResult {
+	r := &ScrubResult{Id: m.Id, FileName: m.FileName, CheckedAt: time.Now().UTC()}
+	s.scrubObject(ctx, r, &m.Object, m.FileSize, full)
+	r.Healthy = len(r.Problems) == 0
+	return r
+}
+
+// scrubObject checks the given object of the given size and records its
+// problems in the result.
+func (s *Server) scrubObject(ctx context.Context, r *ScrubResult, o *Object, size int64, full bool) {
+	if o.chunked() {
+		for i := range o.Chunks {
+			s.scrubObject(ctx, r, &o.Chunks[i].Object, o.Chunks[i].Size, full)
+		}
+		return
+	}
+
+	sum := o.Sha256
+	if o.Shards != nil {
+		// Shards are padded and carry parity, thus only their size is
+		// known in advance.
+		size, sum = o.Shards.ShardSize(), ""
+	}
+	compressed := o.Shards == nil && o.Codec != ""
+	if compressed {
+		size = o.OrigSize
+	}
+	for i, b := range s.store.objects(o) {
+		err := func() error {
+			bk, err := s.store.backends.Lookup(b.Backend)
+			if err != nil {
+				return err
+			}
+			key, err := s.store.keys.unwrap(o.Key)
+			if err != nil {
+				return err
+			}
+			if o.Shards != nil {
+				if key, err = o.Shards.ShardKey(key, i); err != nil {
+					return err
+				}
+			}
+			f, err := bk.Download(ctx, key, b.UploadId)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			if compressed {
+				if full {
+					d, err := decompress(o.Codec, f, size)
+					if err != nil {
+						return err
+					}
+					return verifyFull(d, size, sum)
+				}
+				// The compressed size is not recorded, the samples
+				// are taken up to where the object ends.
+				n, err := f.Seek(0, io.SeekEnd)
+				if err != nil {
+					return err
+				}
+				return verifySamples(f, n)
+			}
+			if full {
+				return verifyFull(f, size, sum)
+			}
+			return verifySamples(f, size)
+		}()
+		if err != nil {
+			r.Problems = append(r.Problems, fmt.Sprintf("%s/%s: %v", b.Backend, b.UploadId, err))
+		}
+	}
+}
+
+// verifyFull reads the object completely, which authenticates every
+// chunk of it, and compares its size and checksum.
+func verifyFull(f io.Reader, size int64, sum string) error {
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("expect %d bytes, got %d", size, n)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); sum != "" && got != sum {
+		return fmt.Errorf("expect sha256 %s, got %s", sum, got)
+	}
+	return nil
+}
+
+// verifySamples checks that the object ends at the expected size, and
+// reads random ranges of it, which authenticates the chunks of these
+// ranges.
+func verifySamples(f io.ReadSeeker, size int64) error {
+	n, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("expect %d bytes, got %d", size, n)
+	}
+	if size == 0 {
+		return nil
+	}
+
+	offsets := []int64{0, size - 1}
+	for i := 0; i < scrubSamples; i++ {
+		offsets = append(offsets, rand.Int63n(size))
+	}
+	buf := make([]byte, scrubSampleSize)
+	for _, off := range offsets {
+		n := int64(len(buf))
+		if size-off < n {
+			n = size - off
+		}
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(f, buf[:n]); err != nil {
+			return fmt.Errorf("read %d bytes at %d: %w", n, off, err)
+		}
+	}
+	return nil
+}
+
+// handleScrubReport responds the latest scrub results. Only unhealthy
+// files are reported if the failed query is given.
+func (s *Server) handleScrubReport(w http.ResponseWriter, r *http.Request) (err error) {
+	failed := r.URL.Query().Get("failed") != ""
+
+	results := []*ScrubResult{}
+	if err = s.db.View(func(t *bbolt.Tx) error {
+		return t.Bucket([]byte(scrubBucket)).ForEach(func(k, v []byte) error {
+			res := &ScrubResult{}
+			if err := json.Unmarshal(v, res); err != nil {
+				return err
+			}
+			if failed && res.Healthy {
+				return nil
+			}
+			results = append(results, res)
+			return nil
+		})
+	}); err != nil {
+		return
+	}
+
+	b, _ := json.Marshal(results)
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	return
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+// replaceObject replaces the stored object of the given file by the
+// given content, which is encrypted by the key of the file.
+func replaceObject(t *testing.T, s *Server, m *Metadata, content []byte) {
+	t.Helper()
+	b := s.store.backends[0]
+	id, err := b.Upload(context.Background(), m.Key, bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	dir := Conf.StoreDirs[0]
+	if err := os.Rename(filepath.Join(dir, id), filepath.Join(dir, m.UploadId)); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	data := make([]byte, 200<<10)
+	rand.Read(data)
+
+	tests := []struct {
+		name   string
+		damage func(t *testing.T, s *Server, m *Metadata)
+	}{
+		{"healthy", nil},
+		{"missing", func(t *testing.T, s *Server, m *Metadata) {
+			os.Remove(filepath.Join(Conf.StoreDirs[0], m.UploadId))
+		}},
+		{"corrupted", func(t *testing.T, s *Server, m *Metadata) {
+			f, _ := os.OpenFile(filepath.Join(Conf.StoreDirs[0], m.UploadId), os.O_RDWR, 0)
+			defer f.Close()
+			f.WriteAt([]byte("void"), 100)
+		}},
+		{"truncated", func(t *testing.T, s *Server, m *Metadata) {
+			replaceObject(t, s, m, data[:len(data)-1])
+		}},
+		{"longer", func(t *testing.T, s *Server, m *Metadata) {
+			replaceObject(t, s, m, append(append([]byte(nil), data...), 0))
+		}},
+	}
+	for _, tt := range tests {
+		for _, full := range []bool{false, true} {
+			name := tt.name + "/sample"
+			if full {
+				name = tt.name + "/full"
+			}
+			t.Run(name, func(t *testing.T) {
+				s := newTestServer(t)
+				Conf.Scrub = scrubSample
+				if full {
+					Conf.Scrub = scrubFull
+				}
+				id := postFile(t, s, "a.bin", data)
+				m := &Metadata{}
+				s.db.View(func(t *bbolt.Tx) error {
+					return json.Unmarshal(t.Bucket([]byte(fileBucket)).Get([]byte(id)), m)
+				})
+				if tt.damage != nil {
+					tt.damage(t, s, m)
+				}
+
+				s.scrubAll(context.Background())
+				r := &ScrubResult{}
+				s.db.View(func(t *bbolt.Tx) error {
+					return json.Unmarshal(t.Bucket([]byte(scrubBucket)).Get([]byte(id)), r)
+				})
+				if r.Healthy != (tt.damage == nil) {
+					t.Fatalf("file is healthy: %v, problems: %v", r.Healthy, r.Problems)
+				}
+			})
+		}
+	}
+}
@@ -7,6 +7,8 @@ package void
 import (
 	"context"
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -21,59 +23,128 @@ import (
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"changkun.de/x/login"
 	"changkun.de/x/void/internal/uuid"
 	"go.etcd.io/bbolt"
-	"golang.design/x/tgstore"
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
 const (
-	fileBucket = "files"
-	tempBucket = "temps"
+	fileBucket    = "files"
+	tempBucket    = "temps"
+	reapBucket    = "reaps"
+	unreapBucket  = "unreaps"
+	scrubBucket   = "scrubs"
+	dedupBucket   = "dedups"
+	chunkBucket   = "chunks"
+	uploadBucket  = "uploads"
+	dirBucket     = "dirs"
+	tagBucket     = "tags"
+	versionBucket = "versions"
+	trashBucket   = "trash"
 )
 
+// tempExpiry is the duration that a reserved id waits for the upload.
+const tempExpiry = 24 * time.Hour
+
+// buckets are all buckets of the database. Buckets that are missing in
+// databases initialized by older versions are created on start.
+var buckets = []string{
+	fileBucket, tempBucket, reapBucket, unreapBucket, scrubBucket, dedupBucket,
+	chunkBucket, uploadBucket, dirBucket, tagBucket, versionBucket, trashBucket,
+}
+
 type Response struct {
-	Id      string `json:"id"`
-	Message string `json:"message"`
+	Id      string   `json:"id"`
+	Ids     []string `json:"ids,omitempty"` // all ids if there are several
+	Message string   `json:"message"`
 }
 
 type Metadata struct {
-	Id        string    `json:"id"`
-	UploadId  string    `json:"upload_id"`
+	Id string `json:"id"`
+	Object
 	FileName  string    `json:"filename"`
 	FileSize  int64     `json:"filesize"`
-	Key       []byte    `json:"key"`
 	Expire    time.Time `json:"expire"`
 	CreatedAt time.Time `json:"created_at"`
+	E2E       *E2E      `json:"e2e,omitempty"`
+
+	// Path is the path of the file in the tree of folders. A new file
+	// may request its folder by a path that ends with a slash.
+	Path string `json:"path,omitempty"`
+
+	// Tags and Attrs are user defined tags and key value attributes.
+	Tags  []string          `json:"tags,omitempty"`
+	Attrs map[string]string `json:"attrs,omitempty"`
+
+	// Version is the version number of the file if versioning is
+	// enabled, where zero is the first version.
+	Version int `json:"version,omitempty"`
+
+	// DeletedAt is the time that the file was moved to the trash, it is
+	// nil for files that are not in the trash.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+
+	// Sealed is the user metadata sealed by the master key, in which
+	// case the file name is empty.
+	Sealed []byte `json:"sealed,omitempty"`
 }
 
 func (m *Metadata) String() string {
-	return fmt.Sprintf("%s\t%s\t%d\t%s", m.Id, m.FileName, m.FileSize, m.UploadId)
+	return fmt.Sprintf("%s\t%s\t%d\t%s\t%s", m.Id, m.FileName, m.FileSize, m.UploadId, m.Path)
 }
 
 type Server struct {
-	store *tgstore.TGStore
+	store *Storage
 	db    *bbolt.DB
+
+	mu        sync.Mutex
+	uploading map[string]bool // resumable uploads that are in progress
 }
 
 func NewServer() *Server {
+	s := newServer(openDB(), NewStorage())
+	if err := indexFiles(s.db); err != nil {
+		log.Fatalf("cannot index files: %v", err)
+	}
+	s.sweepTemps()
+	s.sweepUploads()
+	s.reapDeleted()
+	s.scrubFiles()
+	s.sweepVersions()
+	s.sweepTrash()
+	return s
+}
+
+// openDB opens the configured database and creates missing buckets.
+func openDB() *bbolt.DB {
 	db, err := bbolt.Open(Conf.DB, 0666, &bbolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
 		log.Fatalf("cannot open void.db: %v", err)
 	}
 
-	s := &Server{
-		store: tgstore.New(),
-		db:    db,
+	err = db.Update(func(t *bbolt.Tx) error {
+		for _, b := range buckets {
+			if _, err := t.CreateBucketIfNotExists([]byte(b)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("cannot create buckets: %v", err)
 	}
-	s.store.BotToken = Conf.BotToken
-	s.store.ChatID = Conf.ChatID
-	s.sweepTemps()
-	return s
+	return db
+}
+
+// newServer returns a server that serves the given database and stores
+// file contents in the given storage.
+func newServer(db *bbolt.DB, st *Storage) *Server {
+	return &Server{store: st, db: db, uploading: map[string]bool{}}
 }
 
 func (s *Server) sweepTemps() {
@@ -103,7 +174,8 @@ func (s *Server) sweepTemps() {
 	}()
 }
 
-func (s *Server) Run() {
+// Handler returns the handler of the endpoints that the server serves.
+func (s *Server) Handler() http.Handler {
 	l := func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			defer log.Println(readIP(r), r.Method, r.URL.Path, r.URL.RawQuery)
@@ -111,49 +183,15 @@ func (s *Server) Run() {
 		})
 	}
 
-	http.Handle("/void", l(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var err error
-		defer func() {
-			if err == nil {
-				return
-			}
-
-			if !errors.Is(err, login.ErrUnauthorized) {
-				w.WriteHeader(http.StatusBadRequest)
-			}
-			w.Header().Set("Content-Type", "application/json")
-			b, _ := json.Marshal(Response{Message: err.Error()})
-			w.Write(b)
-			log.Println(err)
-		}()
-
-		_, err = login.HandleAuth(w, r)
-		if err != nil {
-			uu, _ := url.Parse(Conf.SSO)
-			q := uu.Query()
-			q.Set("redirect", "https://"+r.Host+r.URL.String())
-			uu.RawQuery = q.Encode()
-			http.Redirect(w, r, uu.String(), http.StatusFound)
-			return
-		}
-
-		switch r.Method {
-		case http.MethodDelete:
-			err = s.handleDelete(w, r)
-		case http.MethodPut:
-			err = s.handlePut(w, r)
-		case http.MethodGet:
-			err = s.handleGet(w, r)
-		case http.MethodPost:
-			err = s.handlePost(w, r)
-		default:
-			err := fmt.Errorf("%s is not supported", r.Method)
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(err.Error()))
-		}
-	})))
+	mux := http.NewServeMux()
+	mux.Handle("/void", l(http.HandlerFunc(s.handleVoid)))
+	mux.Handle(fsPath, l(http.HandlerFunc(s.handleVoid)))
+	mux.Handle(tusPath, l(http.HandlerFunc(s.handleTus)))
+	return mux
+}
 
-	ss := &http.Server{Addr: Conf.Port, Handler: nil}
+func (s *Server) Run() {
+	ss := &http.Server{Addr: Conf.Port, Handler: s.Handler()}
 	go func() {
 		log.Printf("void server is running at %v/void\n", Conf.Port)
 		if err := ss.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -175,6 +213,64 @@ func (s *Server) Run() {
 	log.Println("server exiting, good bye!")
 }
 
+// handleVoid authenticates the request and dispatches it regards its
+// method, or to the tree of folders regards its path.
+func (s *Server) handleVoid(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		if !errors.Is(err, login.ErrUnauthorized) {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		b, _ := json.Marshal(Response{Message: err.Error()})
+		w.Write(b)
+		log.Println(err)
+	}()
+
+	user, err := login.HandleAuth(w, r)
+	if err != nil {
+		uu, _ := url.Parse(Conf.SSO)
+		q := uu.Query()
+		q.Set("redirect", "https://"+r.Host+r.URL.String())
+		uu.RawQuery = q.Encode()
+		http.Redirect(w, r, uu.String(), http.StatusFound)
+		return
+	}
+	r = r.WithContext(withUser(r.Context(), user))
+	if strings.HasPrefix(r.URL.Path, fsPath) {
+		err = s.handleFs(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		err = s.handleDelete(w, r)
+	case http.MethodPut:
+		err = s.handlePut(w, r)
+	case http.MethodGet, http.MethodHead:
+		err = s.handleGet(w, r)
+	case http.MethodPost:
+		switch r.URL.Query().Get("op") {
+		case "rollback":
+			err = s.handleRollback(w, r, r.URL.Query().Get("id"))
+		case "restore":
+			err = s.handleRestore(w, r, r.URL.Query().Get("id"))
+		default:
+			err = s.handlePost(w, r)
+		}
+	case http.MethodPatch:
+		err = s.handlePatch(w, r, r.URL.Query().Get("id"))
+	default:
+		err := fmt.Errorf("%s is not supported", r.Method)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+	}
+}
+
 func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) (err error) {
 	id := r.URL.Query().Get("id")
 	if id == "" {
@@ -182,12 +278,37 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) (err error
 		return
 	}
 
-	return s.db.Update(func(t *bbolt.Tx) error {
-		return t.Bucket([]byte(fileBucket)).Delete([]byte(id))
+	var queued [][]byte
+	err = s.db.Update(func(t *bbolt.Tx) (err error) {
+		queued, err = deleteFile(t, id)
+		return
 	})
+	if err != nil {
+		return
+	}
+
+	// The file is gone from the index, removing its content is best
+	// effort and retried in the background if it fails. Files in the
+	// trash keep their content until they are purged.
+	for _, id := range queued {
+		s.reap(r.Context(), id)
+	}
+	return
 }
 
+// handlePut reserves and commits files that the client uploads to the
+// backends directly, which requires the direct scope.
 func (s *Server) handlePut(w http.ResponseWriter, r *http.Request) (err error) {
+	var direct bool
+	direct, err = directScope(r)
+	if err != nil {
+		return
+	}
+	if !direct {
+		err = errNoDirectScope
+		return
+	}
+
 	var b []byte
 	b, err = io.ReadAll(r.Body)
 	if err != nil {
@@ -218,12 +339,25 @@ func (s *Server) handlePut(w http.ResponseWriter, r *http.Request) (err error) {
 		}
 
 		// Now we have the upload ID, let's store it to the database.
-		mm.UploadId = n.UploadId
+		// The key was allocated by the server, everything else about
+		// the object is reported by the client. Checksums that index
+		// shared objects are verified first.
+		key := mm.Key
+		mm.Object = n.Object
+		mm.Key = key
 		mm.CreatedAt = time.Now().UTC()
-		err = s.db.Update(func(t *bbolt.Tx) error {
-			d, _ := json.Marshal(mm)
-			return t.Bucket([]byte(fileBucket)).Put([]byte(mm.Id), d)
-		})
+		err = s.verifyUpload(r.Context(), mm)
+		if err != nil {
+			err = fmt.Errorf("upload cannot be verified: %w", err)
+			return
+		}
+		err = s.commit(r.Context(), mm)
+		if err != nil {
+			return
+		}
+		// The file may be a new version of another file and has its id.
+		b, _ = json.Marshal(Response{Id: mm.Id})
+		_, err = w.Write(b)
 		return
 	}
 
@@ -231,37 +365,139 @@ func (s *Server) handlePut(w http.ResponseWriter, r *http.Request) (err error) {
 		Id:       uuid.Must(uuid.NewShort()),
 		FileName: n.FileName,
 		FileSize: n.FileSize,
-		Expire:   time.Now().UTC().Add(24 * time.Hour),
+		Expire:   time.Now().UTC().Add(tempExpiry),
+		E2E:      n.E2E,
+		Path:     n.Path,
+	}
+	m.Tags, err = cleanTags(n.Tags)
+	if err != nil {
+		return
+	}
+	m.Attrs, err = cleanAttrs(n.Attrs)
+	if err != nil {
+		return
 	}
 	m.Key, err = allocKey(chacha20poly1305.KeySize)
 	if err != nil {
 		return
 	}
 
-	b, err = json.Marshal(m)
+	// If the client knows the checksum of the file, and the same content
+	// was uploaded before, the file shares the object right away and
+	// the client can skip the upload. The index only holds checksums
+	// that the server computed or verified, and the file takes the size
+	// of the shared object instead of the reported one. The client does
+	// not prove that it has the content, thus any user of the direct
+	// scope may claim an object by its checksum, which grants nothing
+	// beyond the scope itself, as it reveals the keys of all files.
+	if Conf.Dedup && n.Sha256 != "" {
+		m.Sha256 = n.Sha256
+		shared := false
+		err = s.db.Update(func(t *bbolt.Tx) error {
+			e, err := lookupObject(t, dedupBucket, m.Sha256)
+			if err != nil || e == nil || e.Size == 0 {
+				return err
+			}
+			shared = true
+			m.Expire = time.Time{}
+			m.CreatedAt = time.Now().UTC()
+			if _, err = shareObject(t, m); err != nil {
+				return err
+			}
+			if err = s.sealName(m); err != nil {
+				return err
+			}
+			if Conf.Versioning {
+				if err = supersede(t, m); err != nil {
+					return err
+				}
+			}
+			if err = indexFile(t, m); err != nil {
+				return err
+			}
+			d, _ := json.Marshal(m)
+			return t.Bucket([]byte(fileBucket)).Put([]byte(m.Id), d)
+		})
+		if err != nil {
+			return
+		}
+		if shared {
+			b, _ = json.Marshal(m.publicView())
+			_, err = w.Write(b)
+			return
+		}
+		m.Sha256 = ""
+	}
+
+	// Save it to the temp because we are still missing upload id. The
+	// key is kept wrapped, and the client receives the plain key.
+	tm := *m
+	err = s.store.keys.wrapObject(&tm.Object)
 	if err != nil {
 		return
 	}
-
-	// Save it to the temp because we are still missing upload id.
+	err = s.sealName(&tm)
+	if err != nil {
+		return
+	}
+	b, _ = json.Marshal(&tm)
 	s.db.Update(func(t *bbolt.Tx) error {
 		return t.Bucket([]byte(tempBucket)).Put([]byte(m.Id), b)
 	})
+	b, _ = json.Marshal(m)
+
+	// If the client chunks the file, tell it the chunks that are stored
+	// already, so that it only uploads the others.
+	if len(n.Chunks) > 0 {
+		m.Chunks = n.Chunks
+		for i := range m.Chunks {
+			if o := s.knownChunk(m.Chunks[i].Sha256); o != nil {
+				m.Chunks[i].Object = *o
+			}
+		}
+		b, _ = json.Marshal(m)
+	}
 	_, err = w.Write(b)
 	return
 }
 
 func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) (err error) {
+	switch r.URL.Query().Get("mode") {
+	case "scrub":
+		err = s.handleScrubReport(w, r)
+		return
+	case "trash":
+		err = s.handleTrash(w, r)
+		return
+	}
+
 	id := r.URL.Query().Get("id")
 	if id == "" {
 		err = s.handleList(w, r)
 		return
 	}
+	return s.handleFile(w, r, id)
+}
+
+// handleFile responds the content of the given file, or its metadata
+// in the data mode.
+func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, id string) (err error) {
+	var version int
+	if v := r.URL.Query().Get("version"); v != "" {
+		version, err = strconv.Atoi(v)
+		if err != nil || version <= 0 {
+			err = fmt.Errorf("version is not a positive number, got %s", v)
+			return
+		}
+	}
 
 	var v []byte
 	if err = s.db.View(func(t *bbolt.Tx) error {
 		b := t.Bucket([]byte(fileBucket))
 		v = b.Get([]byte(id))
+		if vv := t.Bucket([]byte(versionBucket)).Get(versionKey(id, version)); v != nil && version > 0 && vv != nil {
+			v = vv
+		}
 		return nil
 	}); err != nil {
 		return
@@ -273,57 +509,108 @@ func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) (err error) {
 		err = fmt.Errorf("id does not exist")
 		return
 	}
+	if version > 0 && versionOf(meta) != version {
+		err = fmt.Errorf("version %d does not exist", version)
+		return
+	}
+	if r.URL.Query().Get("mode") == "versions" {
+		err = s.handleVersions(w, r, meta)
+		return
+	}
 
-	// Data mode: return upload id and key.
+	// Data mode: return the metadata, and the key only in the direct
+	// scope.
 	if r.URL.Query().Get("mode") == "data" {
+		var direct bool
+		direct, err = directScope(r)
+		if err != nil {
+			return
+		}
+		if direct {
+			meta, err = meta.plainView(s.store.keys)
+			if err != nil {
+				return
+			}
+		} else {
+			meta = meta.publicView()
+		}
+		meta = s.nameView(r, meta)
 		b, _ := json.Marshal(meta)
 		w.Header().Set("Content-Type", "application/json")
 		_, err = w.Write(b)
 		return
 	}
 
-	var f io.ReadSeekCloser
-	f, err = s.store.Download(r.Context(), meta.Key, meta.UploadId)
-	if err != nil {
-		err = fmt.Errorf("download with error: %w", err)
-		return
-	}
+	f := newContentReader(r.Context(), s.store, meta)
 	defer f.Close()
+	meta = s.nameView(r, meta)
+
+	// The content of an upload never changes, thus ranges and
+	// conditional requests are validated by the upload id.
+	etag := `"` + meta.UploadId + `"`
+
+	// ServeContent hides the errors of the content behind a generic
+	// internal error, thus the object is opened and sized beforehand,
+	// unless the client has the content already.
+	if !etagMatch(r.Header.Get("If-None-Match"), etag) {
+		if _, err = f.Seek(0, io.SeekEnd); err != nil {
+			err = fmt.Errorf("content is unavailable: %w", err)
+			return
+		}
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			err = fmt.Errorf("content is unavailable: %w", err)
+			return
+		}
+	}
 
-	w.Header().Add("Content-Disposition", `attachment; filename="`+meta.FileName+`"`)
-	w.Header().Add("Content-Length", strconv.FormatInt(meta.FileSize, 10))
-	_, err = io.Copy(w, f)
-	if err != nil {
-		err = fmt.Errorf("download with error: %w", err)
-		return
+	w.Header().Set("Content-Disposition", `attachment; filename="`+meta.FileName+`"`)
+	w.Header().Set("Etag", etag)
+	if sum, e := hex.DecodeString(meta.Sha256); e == nil && len(sum) > 0 {
+		w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum))
 	}
+	http.ServeContent(w, r, meta.FileName, meta.CreatedAt, f)
 	return
 }
 
+// etagMatch reports whether the given If-None-Match header matches the
+// given entity tag.
+func etagMatch(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// handleList lists a page of the files of the ListOptions in the
+// request. The next page is linked by the Link header.
 func (s *Server) handleList(w http.ResponseWriter, r *http.Request) (err error) {
 	raw := false
 	if r.URL.Query().Get("mode") == "data" {
 		raw = true
 	}
 
-	var files []*Metadata
-	if err = s.db.View(func(t *bbolt.Tx) error {
-		b := t.Bucket([]byte(fileBucket))
-		c := b.Cursor()
-
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			file := &Metadata{}
-			err := json.Unmarshal(v, file)
-			if err != nil {
-				return err
-			}
-			files = append(files, file)
-		}
-
-		return nil
-	}); err != nil {
+	var opts *ListOptions
+	opts, err = parseListOptions(r.URL.Query())
+	if err != nil {
+		return
+	}
+	var (
+		files []*Metadata
+		next  string
+	)
+	files, next, err = s.listFiles(r, opts)
+	if err != nil {
 		return
 	}
+	if next != "" {
+		q := r.URL.Query()
+		q.Set("cursor", next)
+		next = "/void?" + q.Encode()
+		w.Header().Set("Link", "<"+next+`>; rel="next"`)
+	}
 	if raw {
 		b, _ := json.Marshal(files)
 		w.Header().Set("Content-Type", "application/json")
@@ -331,7 +618,11 @@ func (s *Server) handleList(w http.ResponseWriter, r *http.Request) (err error)
 		return
 	}
 
-	err = voidTmpl.Execute(w, struct{ All []*Metadata }{files})
+	err = voidTmpl.Execute(w, struct {
+		All  []*Metadata
+		Opts *ListOptions
+		Next string
+	}{files, opts, next})
 	if err != nil {
 		err = fmt.Errorf("failed to render template: %w", err)
 		return
@@ -339,47 +630,142 @@ func (s *Server) handleList(w http.ResponseWriter, r *http.Request) (err error)
 	return nil
 }
 
+// handlePost stores every file of a multipart form. The files are
+// streamed to the backends as they arrive. The "tag" fields, which are
+// comma separated lists, and the "attr" fields of the form "key=value"
+// apply to all files that follow them.
 func (s *Server) handlePost(w http.ResponseWriter, r *http.Request) (err error) {
-	var f multipart.File
-	var h *multipart.FileHeader
+	if Conf.MaxUpload > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, Conf.MaxUpload)
+	}
 
-	f, h, err = r.FormFile("file")
+	var mr *multipart.Reader
+	mr, err = r.MultipartReader()
 	if err != nil {
 		err = fmt.Errorf("uploaded file contains error: %w", err)
 		return
 	}
 
-	m := &Metadata{
-		FileName: h.Filename,
-		FileSize: h.Size,
+	var (
+		ids, names []string
+		e2e        *E2E // the client encryption of the next file
+		dir        = r.URL.Query().Get("dir")
+		tags       []string
+		attrs      = map[string]string{}
+	)
+	for {
+		var p *multipart.Part
+		p, err = mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			err = fmt.Errorf("uploaded file contains error: %w", err)
+			return
+		}
+		if p.FormName() == "e2e" {
+			e2e = &E2E{}
+			if err = json.NewDecoder(p).Decode(e2e); err != nil {
+				err = fmt.Errorf("invalid e2e field: %w", err)
+				return
+			}
+			continue
+		}
+		if name := p.FormName(); name == "tag" || name == "attr" {
+			var b []byte
+			b, err = io.ReadAll(io.LimitReader(p, 1<<16))
+			if err != nil {
+				err = fmt.Errorf("uploaded file contains error: %w", err)
+				return
+			}
+			if name == "tag" {
+				tags = append(tags, splitTags(string(b))...)
+			} else {
+				k, v, _ := strings.Cut(string(b), "=")
+				attrs[k] = v
+			}
+			continue
+		}
+		if p.FormName() != "file" || p.FileName() == "" {
+			continue
+		}
+
+		m := &Metadata{FileName: p.FileName(), E2E: e2e, Path: folderPath(dir)}
+		m.Tags, err = cleanTags(tags)
+		if err != nil {
+			return
+		}
+		m.Attrs, err = cleanAttrs(attrs)
+		if err != nil {
+			return
+		}
+		err = s.postFile(r.Context(), m, p)
+		if err != nil {
+			return
+		}
+		e2e = nil
+		ids = append(ids, m.Id)
+		names = append(names, p.FileName())
+	}
+	if len(ids) == 0 {
+		err = errors.New("uploaded form contains no file")
+		return
 	}
+
+	b, _ := json.Marshal(Response{
+		Id:      ids[0],
+		Ids:     ids,
+		Message: fmt.Sprintf("Upload file %s success.", strings.Join(names, ", ")),
+	})
+	_, err = w.Write(b)
+	return
+}
+
+// postFile stores the given content as the file of the given metadata,
+// which has the user metadata of the file. The size of the file is what
+// was read from the content.
+func (s *Server) postFile(ctx context.Context, m *Metadata, content io.Reader) (err error) {
 	m.Key, err = allocKey(chacha20poly1305.KeySize)
 	if err != nil {
 		return
 	}
 
-	m.UploadId, err = s.store.Upload(r.Context(), m.Key, f)
+	cr := &countingReader{r: content}
+	if Conf.Chunking {
+		err = s.store.PutChunks(ctx, &m.Object, cr, s.knownChunk)
+	} else {
+		err = s.store.Put(ctx, &m.Object, cr)
+	}
 	if err != nil {
 		err = fmt.Errorf("upload failed with error: %w", err)
 		return
 	}
 
 	m.Id = uuid.Must(uuid.NewShort())
+	m.FileSize = cr.n
 	m.CreatedAt = time.Now().UTC()
-	if err = s.db.Update(func(t *bbolt.Tx) error {
-		b := t.Bucket([]byte(fileBucket))
-		d, _ := json.Marshal(m)
-		return b.Put([]byte(m.Id), d)
-	}); err != nil {
-		return
+	err = s.commit(ctx, m)
+	return
+}
+
+// folderPath returns the path that requests the given folder for a new
+// file, or the root folder if it is empty.
+func folderPath(dir string) string {
+	if dir == "" || strings.HasSuffix(dir, "/") {
+		return dir
 	}
+	return dir + "/"
+}
 
-	b, _ := json.Marshal(Response{
-		Id:      m.Id,
-		Message: fmt.Sprintf("Upload file %s success.", h.Filename),
-	})
-	_, err = w.Write(b)
-	return
+// countingReader counts the bytes that are read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.n += int64(n)
+	return n, err
 }
 
 // allocKey allocates a random key regards the given size.
@@ -414,7 +800,14 @@ func readIP(r *http.Request) (ip string) {
 	return ip
 }
 
-var voidTmpl = template.Must(template.New("files").Parse(`<!DOCTYPE html>
+var voidTmpl = template.Must(template.New("files").Funcs(template.FuncMap{
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("2006-01-02")
+	},
+}).Parse(`{{define "head"}}<!DOCTYPE html>
 <html lang="en">
 <head>
 <meta charset="UTF-8">
@@ -461,21 +854,44 @@ footer {
 	}
 }
 </style>
-</head>
+</head>{{end}}{{template "head"}}
 <body>
 <h1>The Void File System</h1>
-<p>void is a zero storage cost file system.</p>
+<p>void is a zero storage cost file system, <a href="/void/fs/">browse the folders</a>.</p>
+
+<form method="get" action="/void">
+{{range .Opts.Tags}}<input type="hidden" name="tag" value="{{.}}">{{end}}
+<input name="q" placeholder="name contains" value="{{.Opts.Search}}">
+<input name="name" placeholder="name pattern, eg. *.pdf" value="{{.Opts.Glob}}">
+<input name="type" placeholder="type, eg. image/*" value="{{.Opts.Type}}">
+<input name="min_size" placeholder="min bytes" value="{{if .Opts.MinSize}}{{.Opts.MinSize}}{{end}}">
+<input name="max_size" placeholder="max bytes" value="{{if .Opts.MaxSize}}{{.Opts.MaxSize}}{{end}}">
+<input name="after" type="date" value="{{date .Opts.After}}">
+<input name="before" type="date" value="{{date .Opts.Before}}">
+<select name="sort">
+<option value="">id</option>
+<option value="name" {{if eq .Opts.Sort "name"}}selected{{end}}>name</option>
+<option value="size" {{if eq .Opts.Sort "size"}}selected{{end}}>size</option>
+<option value="created_at" {{if eq .Opts.Sort "created_at"}}selected{{end}}>created at</option>
+</select>
+<select name="order">
+<option value="asc">ascending</option>
+<option value="desc" {{if .Opts.Desc}}selected{{end}}>descending</option>
+</select>
+<button type="submit">search</button>
+</form>
 
 <table class="table">
-<tr><th>ID</th><th>File Name</th><th>File Size</th></tr>
+<tr><th>ID</th><th>File Name</th><th>File Size</th><th>Created At</th><th>Path</th><th>Tags</th></tr>
 {{range .All}}
-<tr><td>{{.Id}}</td><td><a href="/void?id={{.Id}}">{{.FileName}}</a></td><td>{{.FileSize}}</td></tr>
+<tr><td>{{.Id}}</td><td><a href="/void?id={{.Id}}">{{.FileName}}</a></td><td>{{.FileSize}}</td><td>{{date .CreatedAt}}</td><td><a href="/void/fs{{.Path}}">{{.Path}}</a></td><td>{{range .Tags}}<a href="/void?tag={{.}}">#{{.}}</a> {{end}}</td></tr>
 {{end}}
 </table>
-
+{{if .Next}}<p><a href="{{.Next}}">next page</a></p>{{end}}
+{{template "foot"}}{{define "foot"}}
 <footer>
 <a href="/s/void">void</a> &copy; 2021 Created by Changkun Ou.
 </footer>
 </body>
 </html>
-`))
+{{end}}`))
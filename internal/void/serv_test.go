@@ -0,0 +1,193 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+// newTestServer returns a server of a database and a local backend in a
+// temporary directory, which are configured like the commands see them.
+// The configuration is restored after the test.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	conf := Conf
+	t.Cleanup(func() { Conf = conf })
+
+	dir := t.TempDir()
+	Conf.DB = filepath.Join(dir, "void.db")
+	Conf.Stores, Conf.StoreDirs = []string{storeLocal}, []string{filepath.Join(dir, "store")}
+	s := newServer(openDB(), NewStorage())
+	t.Cleanup(func() { s.db.Close() })
+	return s
+}
+
+// postFiles uploads the given files of names to contents by a form with
+// the context and the query of the given request if any, and returns
+// their ids in the order of the names.
+func postFiles(t *testing.T, s *Server, r *http.Request, names []string, files map[string][]byte, fields ...string) []string {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for i := 0; i+1 < len(fields); i += 2 {
+		mw.WriteField(fields[i], fields[i+1])
+	}
+	for _, name := range names {
+		fw, _ := mw.CreateFormFile("file", name)
+		fw.Write(files[name])
+	}
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/void", body)
+	if r != nil {
+		req = req.WithContext(r.Context())
+		req.URL.RawQuery = r.URL.RawQuery
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	if err := s.handlePost(w, req); err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	resp := &Response{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil || len(resp.Ids) != len(names) {
+		t.Fatalf("post responds %s: %v", w.Body, err)
+	}
+	return resp.Ids
+}
+
+// postFile uploads a file of the given name and content, and returns
+// its id.
+func postFile(t *testing.T, s *Server, name string, data []byte, fields ...string) string {
+	t.Helper()
+	return postFiles(t, s, nil, []string{name}, map[string][]byte{name: data}, fields...)[0]
+}
+
+// getFile sends a GET of the given query as the given request does, or
+// as an anonymous user if it is nil.
+func getFile(t *testing.T, s *Server, r *http.Request, query string, header ...string) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/void?"+query, nil)
+	if r != nil {
+		req = req.WithContext(r.Context())
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	return w, s.handleGet(w, req)
+}
+
+// metadata returns the metadata of the given file in the data mode.
+func metadata(t *testing.T, s *Server, r *http.Request, id string) *Metadata {
+	t.Helper()
+	w, err := getFile(t, s, r, "mode=data&id="+id)
+	if err != nil {
+		t.Fatalf("metadata of %s: %v", id, err)
+	}
+	m := &Metadata{}
+	if err := json.Unmarshal(w.Body.Bytes(), m); err != nil {
+		t.Fatalf("metadata of %s: %v", id, err)
+	}
+	return m
+}
+
+func TestPostGet(t *testing.T) {
+	compressible := bytes.Repeat([]byte("void stores files "), 20000)
+	random := make([]byte, 300<<10)
+	rand.Read(random)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		setup func(s *Server)
+	}{
+		{"empty", nil, nil},
+		{"small", []byte("hello void"), nil},
+		{"large", random, nil},
+		{"compressed", compressible, func(s *Server) { s.store.codec = codecGzip }},
+		{"erasure", random, func(s *Server) { s.store.erasure.Data, s.store.erasure.Parity = 2, 1 }},
+		{"chunked", random, func(s *Server) { Conf.Chunking = true }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			if tt.setup != nil {
+				tt.setup(s)
+			}
+			id := postFile(t, s, tt.name+".bin", tt.data)
+
+			w, err := getFile(t, s, nil, "id="+id)
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), tt.data) {
+				t.Fatalf("get responds %d of %d bytes, want %d bytes", w.Code, w.Body.Len(), len(tt.data))
+			}
+			if d := w.Header().Get("Content-Disposition"); !strings.Contains(d, tt.name+".bin") {
+				t.Fatalf("get responds disposition %q", d)
+			}
+
+			if len(tt.data) > 100 {
+				w, err = getFile(t, s, nil, "id="+id, "Range", "bytes=10-99")
+				if err != nil || w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), tt.data[10:100]) {
+					t.Fatalf("range responds %d of %d bytes: %v", w.Code, w.Body.Len(), err)
+				}
+			}
+
+			m := metadata(t, s, nil, id)
+			sum := sha256.Sum256(tt.data)
+			if m.FileName != tt.name+".bin" || m.FileSize != int64(len(tt.data)) || m.Sha256 != hex.EncodeToString(sum[:]) {
+				t.Fatalf("metadata is %s, size %d, sha256 %s", m.FileName, m.FileSize, m.Sha256)
+			}
+			if m.Key != nil {
+				t.Fatalf("metadata reveals the key")
+			}
+		})
+	}
+}
+
+func TestGetUnavailable(t *testing.T) {
+	s := newTestServer(t)
+	id := postFile(t, s, "a.txt", []byte("hello void"))
+
+	// The content is lost in the backend.
+	dir := Conf.StoreDirs[0]
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		os.Remove(filepath.Join(dir, e.Name()))
+	}
+
+	w, err := getFile(t, s, nil, "id="+id)
+	if err == nil || !strings.Contains(err.Error(), "content is unavailable") {
+		t.Fatalf("get of a lost content: %v, want an error", err)
+	}
+	if w.Body.Len() > 0 {
+		t.Fatalf("get of a lost content responds %q", w.Body)
+	}
+
+	// Clients that have the content are answered without it.
+	m := &Metadata{}
+	s.db.View(func(t *bbolt.Tx) error {
+		return json.Unmarshal(t.Bucket([]byte(fileBucket)).Get([]byte(id)), m)
+	})
+	w, err = getFile(t, s, nil, "id="+id, "If-None-Match", `"`+m.UploadId+`"`)
+	if err != nil || w.Code != http.StatusNotModified {
+		t.Fatalf("conditional get responds %d: %v", w.Code, err)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+
+	"changkun.de/x/void/internal/store"
+)
+
+// Object describes where and how the content of a file is stored in
+// the backends.
+type Object struct {
+	UploadId string          `json:"upload_id"`
+	Sha256   string          `json:"sha256,omitempty"`
+	Key      []byte          `json:"key,omitempty"`
+	Replicas []store.Replica `json:"replicas,omitempty"`
+	Shards   *store.Shards   `json:"shards,omitempty"`
+	Chunks   []Chunk         `json:"chunks,omitempty"`
+
+	// Codec is the compression of the content before it is encrypted,
+	// and OrigSize is the size of the content before compression.
+	Codec    string `json:"codec,omitempty"`
+	OrigSize int64  `json:"orig_size,omitempty"`
+}
+
+// Storage stores the contents of files in the configured backends.
+// Both the server and the command line go through it, so that the
+// recorded metadata is understood by either side.
+type Storage struct {
+	backends store.Replicated
+	erasure  *store.Erasure
+	codec    string   // compression of new objects, empty for none
+	keys     *keyring // unwraps the keys of objects in the database
+}
+
+// NewStorage returns a storage that stores files in the backends
+// selected by the configuration.
+func NewStorage() *Storage {
+	st := newStorage(NewBackends(), Conf.DataShards, Conf.ParityShards)
+	st.codec = Conf.Compress
+
+	var err error
+	st.keys, err = newKeyring(Conf.KEK, Conf.OldKEKs...)
+	if err != nil {
+		log.Fatalf("invalid master key: %v", err)
+	}
+	return st
+}
+
+// newStorage returns a storage that replicates files to all backends,
+// or spreads erasure coded shards over them if data is positive.
+func newStorage(backends store.Replicated, data, parity int) *Storage {
+	return &Storage{
+		backends: backends,
+		erasure:  &store.Erasure{Backends: backends, Data: data, Parity: parity},
+	}
+}
+
+// Put uploads the content of a file and records where the content is
+// stored as well as its checksum in the given object. The object must
+// contain the key.
+func (st *Storage) Put(ctx context.Context, o *Object, content io.Reader) (err error) {
+	if len(st.backends) == 0 {
+		return errors.New("no backend is configured")
+	}
+
+	h := sha256.New()
+	content = io.TeeReader(content, h)
+	defer func() {
+		if err == nil {
+			o.Sha256 = hex.EncodeToString(h.Sum(nil))
+		}
+	}()
+
+	o.Codec, o.OrigSize = st.codec, 0
+	if o.Codec != "" {
+		zr, err := compress(o.Codec, content, func(n int64) { o.OrigSize = n })
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		content = zr
+	}
+
+	if st.erasure.Data > 0 {
+		shards, err := st.erasure.Upload(ctx, o.Key, content)
+		if err != nil {
+			return err
+		}
+		o.UploadId = shards.Shards[0].UploadId
+		o.Shards = shards
+		return nil
+	}
+
+	replicas, err := st.backends.Upload(ctx, o.Key, content)
+	if err != nil {
+		return err
+	}
+	o.UploadId = replicas[0].UploadId
+	o.Replicas = replicas
+	return nil
+}
+
+// Open returns a reader of the content that is stored in the given
+// object.
+func (st *Storage) Open(ctx context.Context, o *Object) (io.ReadSeekCloser, error) {
+	if o.chunked() {
+		return st.openChunks(ctx, o), nil
+	}
+	if o.Codec != "" {
+		raw, err := st.openRaw(ctx, o)
+		if err != nil {
+			return nil, err
+		}
+		return decompress(o.Codec, raw, o.OrigSize)
+	}
+	return st.openRaw(ctx, o)
+}
+
+// openRaw returns a reader of the content of the given object as it is
+// stored in the backends.
+func (st *Storage) openRaw(ctx context.Context, o *Object) (io.ReadSeekCloser, error) {
+	key, err := st.keys.unwrap(o.Key)
+	if err != nil {
+		return nil, err
+	}
+	if o.Shards != nil {
+		return st.erasure.Download(ctx, key, o.Shards)
+	}
+	return st.backends.Download(ctx, key, o.replicas())
+}
+
+// replicas returns all replicas of the object. Objects that were uploaded
+// before replication was introduced only live in the first backend.
+func (o *Object) replicas() []store.Replica {
+	if len(o.Replicas) > 0 {
+		return o.Replicas
+	}
+	return []store.Replica{{UploadId: o.UploadId}}
+}
+
+// Remove removes the given object from all backends. The chunks of a
+// chunked object are shared and must be removed one by one.
+func (st *Storage) Remove(ctx context.Context, o *Object) error {
+	if o.chunked() {
+		return nil
+	}
+	if o.Shards != nil {
+		return st.erasure.Delete(ctx, o.Shards)
+	}
+	return st.backends.Delete(ctx, o.replicas())
+}
+
+// objects returns the objects in the backends that store the content of
+// the given object.
+func (st *Storage) objects(o *Object) []store.Replica {
+	if o.chunked() {
+		var objs []store.Replica
+		for i := range o.Chunks {
+			objs = append(objs, st.objects(&o.Chunks[i].Object)...)
+		}
+		return objs
+	}
+	if o.Shards != nil {
+		return o.Shards.Shards
+	}
+
+	objs := append([]store.Replica(nil), o.replicas()...)
+	for i := range objs {
+		if objs[i].Backend == "" && len(st.backends) > 0 {
+			objs[i].Backend = st.backends[0].Name
+		}
+	}
+	return objs
+}
@@ -0,0 +1,256 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"go.etcd.io/bbolt"
+)
+
+// Files carry user defined tags and key value attributes. The tags are
+// stored in plaintext even if names are sealed, whereas the attributes
+// are sealed together with the names. The tag bucket indexes
+// the files by their tags: the key of a tagged file is the tag and the
+// id separated by a zero byte, and its value is the id, thus the files
+// of a tag are a range of keys.
+
+// Patch edits the tags and the attributes of a file.
+type Patch struct {
+	Tags   []string          `json:"tags,omitempty"`   // tags to add
+	Untags []string          `json:"untags,omitempty"` // tags to remove
+	Attrs  map[string]string `json:"attrs,omitempty"`  // attributes to set, or to remove by an empty value
+}
+
+// cleanTags returns the given tags without surrounding spaces, empty
+// tags and duplicates in sorted order. Tags must not contain commas,
+// which separate tags in lists.
+func cleanTags(tags []string) ([]string, error) {
+	seen := map[string]bool{}
+	var cleaned []string
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		switch {
+		case tag == "" || seen[tag]:
+			continue
+		case strings.ContainsAny(tag, ",\x00"):
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		seen[tag] = true
+		cleaned = append(cleaned, tag)
+	}
+	sort.Strings(cleaned)
+	return cleaned, nil
+}
+
+// cleanAttrs returns the given attributes without empty values.
+func cleanAttrs(attrs map[string]string) (map[string]string, error) {
+	var cleaned map[string]string
+	for k, v := range attrs {
+		if k == "" || strings.Contains(k, "=") {
+			return nil, fmt.Errorf("invalid attribute name %q", k)
+		}
+		if v == "" {
+			continue
+		}
+		if cleaned == nil {
+			cleaned = map[string]string{}
+		}
+		cleaned[k] = v
+	}
+	return cleaned, nil
+}
+
+// splitTags splits the given comma separated list of tags.
+func splitTags(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
+// tagKey returns the key of the given file in the tag index.
+func tagKey(tag, id string) []byte {
+	return []byte(tag + "\x00" + id)
+}
+
+// hasTags reports whether the given file has all the given tags.
+func hasTags(m *Metadata, tags []string) bool {
+	for _, tag := range tags {
+		i := sort.SearchStrings(m.Tags, tag)
+		if i == len(m.Tags) || m.Tags[i] != tag {
+			return false
+		}
+	}
+	return true
+}
+
+// taggedFiles returns the ids of the files that have all the given
+// tags within the transaction, which must be at least one.
+func taggedFiles(t *bbolt.Tx, tags []string) (ids []string) {
+	b := t.Bucket([]byte(tagBucket))
+	prefix := tagKey(tags[0], "")
+	c := b.Cursor()
+next:
+	for k, v := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, v = c.Next() {
+		for _, tag := range tags[1:] {
+			if b.Get(tagKey(tag, string(v))) == nil {
+				continue next
+			}
+		}
+		ids = append(ids, string(v))
+	}
+	return ids
+}
+
+// indexFile adds the given file to the tree of folders and the tag
+// index within the transaction.
+func indexFile(t *bbolt.Tx, m *Metadata) error {
+	if err := linkFile(t, m); err != nil {
+		return err
+	}
+	b := t.Bucket([]byte(tagBucket))
+	for _, tag := range m.Tags {
+		if err := b.Put(tagKey(tag, m.Id), []byte(m.Id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexFile removes the given file from the tree of folders and the
+// tag index within the transaction.
+func unindexFile(t *bbolt.Tx, m *Metadata) error {
+	if err := unlinkFile(t, m); err != nil {
+		return err
+	}
+	b := t.Bucket([]byte(tagBucket))
+	for _, tag := range m.Tags {
+		if err := b.Delete(tagKey(tag, m.Id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// patchFile applies the given patch to the given file and returns the
+// edited metadata. The attributes of a file whose metadata is sealed
+// are edited within the seal.
+func (s *Server) patchFile(id string, p *Patch) (m *Metadata, err error) {
+	add, err := cleanTags(p.Tags)
+	if err != nil {
+		return nil, err
+	}
+	remove, err := cleanTags(p.Untags)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := cleanAttrs(p.Attrs); err != nil {
+		return nil, err
+	}
+
+	err = s.db.Update(func(t *bbolt.Tx) error {
+		files := t.Bucket([]byte(fileBucket))
+		m = &Metadata{}
+		if err := json.Unmarshal(files.Get([]byte(id)), m); err != nil || m.UploadId == "" {
+			return errors.New("id does not exist")
+		}
+
+		tags := t.Bucket([]byte(tagBucket))
+		for _, tag := range remove {
+			if err := tags.Delete(tagKey(tag, m.Id)); err != nil {
+				return err
+			}
+		}
+		for _, tag := range add {
+			if err := tags.Put(tagKey(tag, m.Id), []byte(m.Id)); err != nil {
+				return err
+			}
+		}
+		kept := m.Tags[:0]
+		for _, tag := range m.Tags {
+			if !contains(remove, tag) {
+				kept = append(kept, tag)
+			}
+		}
+		m.Tags, _ = cleanTags(append(kept, add...))
+
+		if m.Sealed == nil {
+			m.Attrs = patchAttrs(m.Attrs, p.Attrs)
+		} else if len(p.Attrs) > 0 {
+			um, _, err := s.store.keys.openMeta(m.Sealed, m.Id)
+			if err != nil {
+				return err
+			}
+			um.Attrs = patchAttrs(sealedAttrs(m, um), p.Attrs)
+			if m.Sealed, err = s.store.keys.sealMeta(um, m.Id); err != nil {
+				return err
+			}
+			m.Attrs = nil
+		}
+
+		d, _ := json.Marshal(m)
+		return files.Put([]byte(id), d)
+	})
+	return
+}
+
+// patchAttrs sets the given attributes, or removes those of an empty
+// value.
+func patchAttrs(attrs, set map[string]string) map[string]string {
+	if attrs == nil {
+		attrs = map[string]string{}
+	}
+	for k, v := range set {
+		attrs[k] = v
+	}
+	attrs, _ = cleanAttrs(attrs)
+	return attrs
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// handlePatch edits the tags and the attributes of the given file by
+// the Patch in the request, and responds the edited metadata.
+func (s *Server) handlePatch(w http.ResponseWriter, r *http.Request, id string) (err error) {
+	if id == "" {
+		err = errors.New("missing id for the patch")
+		return
+	}
+
+	var b []byte
+	b, err = io.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	p := &Patch{}
+	err = json.Unmarshal(b, p)
+	if err != nil {
+		return
+	}
+
+	var m *Metadata
+	m, err = s.patchFile(id, p)
+	if err != nil {
+		return
+	}
+	b, _ = json.Marshal(s.nameView(r, m.publicView()))
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	return
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+// listIds returns the sorted ids of the files that the list of the
+// given query responds.
+func listIds(t *testing.T, s *Server, query string) []string {
+	t.Helper()
+	w, err := getFile(t, s, nil, "mode=data&"+query)
+	if err != nil {
+		t.Fatalf("list %s: %v", query, err)
+	}
+	var files []*Metadata
+	if err := json.Unmarshal(w.Body.Bytes(), &files); err != nil {
+		t.Fatalf("list %s responds %s: %v", query, w.Body, err)
+	}
+	var ids []string
+	for _, m := range files {
+		ids = append(ids, m.Id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestTags(t *testing.T) {
+	s := newTestServer(t)
+	a := postFile(t, s, "a.txt", []byte("a"), "tag", "red,blue")
+	b := postFile(t, s, "b.txt", []byte("b"), "tag", "red")
+	both := []string{a, b}
+	sort.Strings(both)
+
+	body, _ := json.Marshal(&Patch{Tags: []string{"green"}, Untags: []string{"blue"}})
+	req := httptest.NewRequest(http.MethodPatch, "/void?id="+a, bytes.NewReader(body))
+	if err := s.handlePatch(httptest.NewRecorder(), req, a); err != nil {
+		t.Fatalf("patch: %v", err)
+	}
+
+	// The index follows the patch.
+	s.db.View(func(tx *bbolt.Tx) error {
+		tags := tx.Bucket([]byte(tagBucket))
+		if tags.Get(tagKey("blue", a)) != nil || tags.Get(tagKey("green", a)) == nil {
+			t.Errorf("tag index is not patched")
+		}
+		return nil
+	})
+
+	tests := []struct {
+		query string
+		ids   []string
+	}{
+		{"", both},
+		{"tag=red", both},
+		{"tag=blue", nil},
+		{"tag=green", []string{a}},
+		{"tag=red&tag=green", []string{a}},
+		{"tag=green&tag=unknown", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if ids := listIds(t, s, tt.query); strings.Join(ids, ",") != strings.Join(tt.ids, ",") {
+				t.Fatalf("list is %v, want %v", ids, tt.ids)
+			}
+		})
+	}
+}
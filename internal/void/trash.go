@@ -0,0 +1,181 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// Deleted files are moved to the trash bucket with the time of their
+// deletion if the trash is enabled. They are out of the tree of folders
+// and the tag index, but keep their objects and previous versions until
+// they are restored or purged after the retention of the trash.
+
+// defaultTrashDays is the days that deleted files are kept by default.
+const defaultTrashDays = 30
+
+// trashFile moves the record of a file to the trash bucket within the
+// transaction.
+func trashFile(t *bbolt.Tx, id string) error {
+	files := t.Bucket([]byte(fileBucket))
+	m := &Metadata{}
+	if err := json.Unmarshal(files.Get([]byte(id)), m); err != nil || m.UploadId == "" {
+		return errors.New("id does not exist")
+	}
+	if err := unindexFile(t, m); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	m.DeletedAt = &now
+	b, _ := json.Marshal(m)
+	if err := t.Bucket([]byte(trashBucket)).Put([]byte(id), b); err != nil {
+		return err
+	}
+	return files.Delete([]byte(id))
+}
+
+// deleteFile deletes a file within the transaction, either to the trash
+// or for good if the trash is disabled. It returns the ids of the
+// queued objects.
+func deleteFile(t *bbolt.Tx, id string) (queued [][]byte, err error) {
+	if Conf.TrashDays > 0 {
+		return nil, trashFile(t, id)
+	}
+	return removeFile(t, fileBucket, []byte(id))
+}
+
+// restore moves a file from the trash back to the files. It returns to
+// its path, or is named after its id as well if the path is taken, and
+// the folders of the path are created again.
+func (s *Server) restore(id string) (m *Metadata, err error) {
+	err = s.db.Update(func(t *bbolt.Tx) error {
+		trash := t.Bucket([]byte(trashBucket))
+		m = &Metadata{}
+		if err := json.Unmarshal(trash.Get([]byte(id)), m); err != nil || m.UploadId == "" {
+			return errors.New("id is not in the trash")
+		}
+		m.DeletedAt = nil
+		if err := indexFile(t, m); err != nil {
+			return err
+		}
+		b, _ := json.Marshal(m)
+		if err := t.Bucket([]byte(fileBucket)).Put([]byte(id), b); err != nil {
+			return err
+		}
+		return trash.Delete([]byte(id))
+	})
+	return
+}
+
+// deletedAt returns the time that the given file was moved to the
+// trash, or the zero time if it is unknown.
+func deletedAt(m *Metadata) time.Time {
+	if m.DeletedAt == nil {
+		return time.Time{}
+	}
+	return *m.DeletedAt
+}
+
+// handleTrash responds the files in the trash, the latest deleted file
+// first.
+func (s *Server) handleTrash(w http.ResponseWriter, r *http.Request) (err error) {
+	var files []*Metadata
+	err = s.db.View(func(t *bbolt.Tx) error {
+		return t.Bucket([]byte(trashBucket)).ForEach(func(k, v []byte) error {
+			m := &Metadata{}
+			if err := json.Unmarshal(v, m); err != nil {
+				return nil // reported by fsck
+			}
+			files = append(files, s.nameView(r, m.publicView()))
+			return nil
+		})
+	})
+	if err != nil {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return deletedAt(files[i]).After(deletedAt(files[j])) })
+
+	b, _ := json.Marshal(files)
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	return
+}
+
+// handleRestore restores the given file from the trash, and responds
+// the metadata of the file.
+func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request, id string) (err error) {
+	if id == "" {
+		err = errors.New("missing id for the restore")
+		return
+	}
+
+	var m *Metadata
+	m, err = s.restore(id)
+	if err != nil {
+		return
+	}
+	b, _ := json.Marshal(s.nameView(r, m.publicView()))
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	return
+}
+
+// sweepTrash periodically purges the files that are in the trash for
+// longer than the retention.
+func (s *Server) sweepTrash() {
+	if Conf.TrashDays == 0 {
+		return
+	}
+
+	go func() {
+		t := time.NewTicker(time.Hour)
+		for range t.C {
+			s.purgeTrash(context.Background())
+		}
+	}()
+}
+
+// purgeTrash removes the files that were deleted more than TrashDays
+// days ago, together with their objects and previous versions. The
+// contents that a backend cannot delete stay in it, and their objects
+// are kept in the reap queue.
+func (s *Server) purgeTrash(ctx context.Context) {
+	var queued [][]byte
+	s.db.Update(func(t *bbolt.Tx) error {
+		var expired [][]byte
+		t.Bucket([]byte(trashBucket)).ForEach(func(k, v []byte) error {
+			m := &Metadata{}
+			if err := json.Unmarshal(v, m); err != nil || m.DeletedAt == nil {
+				return nil // reported by fsck
+			}
+			if time.Since(*m.DeletedAt) > time.Duration(Conf.TrashDays)*24*time.Hour {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+
+		for _, k := range expired {
+			q, err := removeFile(t, trashBucket, k)
+			if err != nil {
+				log.Printf("item %s cannot be purged: %v\n", k, err)
+				continue
+			}
+			queued = append(queued, q...)
+			log.Printf("item %s was purged from the trash, its contents are reaped from the backends if they can delete them.\n", k)
+		}
+		return nil
+	})
+	for _, id := range queued {
+		s.reap(ctx, id)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// trashed returns the record of the given file in the trash, or nil if
+// it is not in the trash.
+func trashed(s *Server, id string) (m *Metadata) {
+	s.db.View(func(t *bbolt.Tx) error {
+		if v := t.Bucket([]byte(trashBucket)).Get([]byte(id)); v != nil {
+			m = &Metadata{}
+			json.Unmarshal(v, m)
+		}
+		return nil
+	})
+	return m
+}
+
+// deleteId deletes the given file.
+func deleteId(t *testing.T, s *Server, id string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodDelete, "/void?id="+id, nil)
+	if err := s.handleDelete(httptest.NewRecorder(), req); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	s := newTestServer(t)
+	Conf.TrashDays = defaultTrashDays
+	id := postFile(t, s, "a.txt", []byte("hello void"), "tag", "red")
+	m := metadata(t, s, nil, id)
+
+	// A deleted file is out of the tree and the tag index, but keeps its
+	// object.
+	deleteId(t, s, id)
+	if trashed(s, id) == nil {
+		t.Fatalf("deleted file is not in the trash")
+	}
+	if _, err := getFile(t, s, nil, "mode=data&id="+id); err == nil {
+		t.Fatalf("deleted file is still served")
+	}
+	if ids := listIds(t, s, "tag=red"); len(ids) != 0 {
+		t.Fatalf("deleted file is still tagged: %v", ids)
+	}
+	if _, err := fsRequest(t, s, http.MethodGet, "/a.txt", "mode=data"); err == nil {
+		t.Fatalf("deleted file is still in the tree")
+	}
+	if _, err := os.Stat(filepath.Join(Conf.StoreDirs[0], m.UploadId)); err != nil {
+		t.Fatalf("object of a deleted file is removed: %v", err)
+	}
+
+	// A restored file returns to its path and its tags.
+	if _, err := s.restore(id); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if trashed(s, id) != nil {
+		t.Fatalf("restored file is still in the trash")
+	}
+	if ids := listIds(t, s, "tag=red"); len(ids) != 1 || ids[0] != id {
+		t.Fatalf("restored file is not tagged: %v", ids)
+	}
+	if w, err := fsRequest(t, s, http.MethodGet, "/a.txt", ""); err != nil || w.Body.String() != "hello void" {
+		t.Fatalf("restored file responds %q: %v", w.Body, err)
+	}
+
+	// A file is restored next to the file that took its path.
+	deleteId(t, s, id)
+	other := postFile(t, s, "a.txt", []byte("another void"))
+	restored, err := s.restore(id)
+	if err != nil {
+		t.Fatalf("restore to a taken path: %v", err)
+	}
+	if want := "/a (" + id + ").txt"; restored.Path != want {
+		t.Fatalf("restored file is at %s, want %s", restored.Path, want)
+	}
+	if w, err := fsRequest(t, s, http.MethodGet, "/a.txt", ""); err != nil || w.Body.String() != "another void" {
+		t.Fatalf("file that took the path responds %q: %v", w.Body, err)
+	}
+	if _, err := s.restore(other); err == nil {
+		t.Fatalf("restore of a file that is not in the trash succeeds")
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	s := newTestServer(t)
+	Conf.TrashDays = defaultTrashDays
+	old := postFile(t, s, "old.txt", []byte("old void"))
+	recent := postFile(t, s, "recent.txt", []byte("recent void"))
+	deleteId(t, s, old)
+	deleteId(t, s, recent)
+
+	m := trashed(s, old)
+	deleted := time.Now().Add(-(defaultTrashDays + 1) * 24 * time.Hour)
+	m.DeletedAt = &deleted
+	putRecord(s, trashBucket, old, m)
+
+	s.purgeTrash(context.Background())
+	if trashed(s, old) != nil {
+		t.Fatalf("expired file is not purged")
+	}
+	if _, err := os.Stat(filepath.Join(Conf.StoreDirs[0], m.UploadId)); !os.IsNotExist(err) {
+		t.Fatalf("object of a purged file is kept: %v", err)
+	}
+	if trashed(s, recent) == nil {
+		t.Fatalf("recently deleted file is purged")
+	}
+}
@@ -0,0 +1,406 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"changkun.de/x/login"
+	"changkun.de/x/void/internal/uuid"
+	"go.etcd.io/bbolt"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// The resumable uploads implement the tus protocol, see
+// https://tus.io/protocols/resumable-upload.html. An upload receives
+// the content piece by piece in a staging file next to the database,
+// and the file is stored and committed once the content is complete.
+// The upload id becomes the id of the file.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+	tusPath       = "/void/tus/"
+)
+
+// upload is the state of a resumable upload.
+type upload struct {
+	Metadata
+	Offset int64 `json:"offset"`
+}
+
+// uploadPath returns the staging file of the given upload.
+func uploadPath(id string) string {
+	return filepath.Join(strings.TrimSuffix(Conf.DB, ".db")+".uploads", id)
+}
+
+// lockUpload marks the given upload as busy. It reports false if the
+// upload is busy already.
+func (s *Server) lockUpload(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.uploading[id] {
+		return false
+	}
+	s.uploading[id] = true
+	return true
+}
+
+func (s *Server) unlockUpload(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uploading, id)
+}
+
+// loadUpload returns the given upload, or nil if it does not exist or
+// was expired.
+func (s *Server) loadUpload(id string) (*upload, error) {
+	var v []byte
+	s.db.View(func(t *bbolt.Tx) error {
+		v = t.Bucket([]byte(uploadBucket)).Get([]byte(id))
+		return nil
+	})
+	if v == nil {
+		return nil, nil
+	}
+	u := &upload{}
+	if err := json.Unmarshal(v, u); err != nil {
+		return nil, err
+	}
+	if time.Since(u.Expire) > 0 {
+		return nil, nil
+	}
+	return u, nil
+}
+
+func (s *Server) saveUpload(u *upload) error {
+	if err := s.sealName(&u.Metadata); err != nil {
+		return err
+	}
+	b, _ := json.Marshal(u)
+	return s.db.Update(func(t *bbolt.Tx) error {
+		return t.Bucket([]byte(uploadBucket)).Put([]byte(u.Id), b)
+	})
+}
+
+// removeUpload removes the state and the staging file of an upload.
+func (s *Server) removeUpload(id string) error {
+	err := s.db.Update(func(t *bbolt.Tx) error {
+		return t.Bucket([]byte(uploadBucket)).Delete([]byte(id))
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(uploadPath(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// handleTus authenticates the request and dispatches it to the tus
+// protocol handlers. Errors are responded with a status code as the
+// protocol requires.
+func (s *Server) handleTus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if m := r.Header.Get("X-HTTP-Method-Override"); m != "" {
+		r.Method = m
+	}
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		if Conf.MaxUpload > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(Conf.MaxUpload, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	code, err := http.StatusUnauthorized, error(nil)
+	defer func() {
+		if err == nil {
+			return
+		}
+		http.Error(w, err.Error(), code)
+		log.Println(err)
+	}()
+
+	if _, err = login.HandleAuth(w, r); err != nil {
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		code, err = http.StatusPreconditionFailed, fmt.Errorf("tus version %q is not supported", r.Header.Get("Tus-Resumable"))
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, tusPath)
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		code, err = s.handleTusCreate(w, r)
+	case id != "" && r.Method == http.MethodHead:
+		code, err = s.handleTusHead(w, r, id)
+	case id != "" && r.Method == http.MethodPatch:
+		code, err = s.handleTusPatch(w, r, id)
+	case id != "" && r.Method == http.MethodDelete:
+		code, err = s.handleTusDelete(w, r, id)
+	default:
+		code, err = http.StatusMethodNotAllowed, fmt.Errorf("%s is not supported", r.Method)
+	}
+}
+
+// handleTusCreate creates an upload of the length, the file name, the
+// folder and the comma separated tags in the request.
+func (s *Server) handleTusCreate(w http.ResponseWriter, r *http.Request) (int, error) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return http.StatusBadRequest, errors.New("invalid Upload-Length")
+	}
+	if Conf.MaxUpload > 0 && length > Conf.MaxUpload {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("upload exceeds the maximum of %d bytes", Conf.MaxUpload)
+	}
+
+	meta := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	u := &upload{Metadata: Metadata{
+		Id:       uuid.Must(uuid.NewShort()),
+		FileName: meta["filename"],
+		FileSize: length,
+		Expire:   time.Now().UTC().Add(tempExpiry),
+		Path:     folderPath(meta["dir"]),
+	}}
+	if u.FileName == "" {
+		u.FileName = meta["name"]
+	}
+	if u.Tags, err = cleanTags(splitTags(meta["tags"])); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if err := s.saveUpload(u); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	w.Header().Set("Location", tusPath+u.Id)
+	if length == 0 {
+		if err := s.finishUpload(r.Context(), u); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	w.Header().Set("Upload-Expires", u.Expire.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+	return 0, nil
+}
+
+// handleTusHead responds the offset of an upload.
+func (s *Server) handleTusHead(w http.ResponseWriter, r *http.Request, id string) (int, error) {
+	u, err := s.loadUpload(id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	} else if u == nil {
+		return http.StatusNotFound, errors.New("upload does not exist")
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.FileSize, 10))
+	w.Header().Set("Upload-Expires", u.Expire.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+	return 0, nil
+}
+
+// handleTusPatch appends the content of the request to an upload. The
+// received part is kept even if the request breaks, and the upload is
+// finished once its content is complete.
+func (s *Server) handleTusPatch(w http.ResponseWriter, r *http.Request, id string) (int, error) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		return http.StatusUnsupportedMediaType, errors.New("content type is not application/offset+octet-stream")
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, errors.New("invalid Upload-Offset")
+	}
+
+	if !s.lockUpload(id) {
+		return http.StatusLocked, errors.New("upload is in progress")
+	}
+	defer s.unlockUpload(id)
+
+	u, err := s.loadUpload(id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	} else if u == nil {
+		return http.StatusNotFound, errors.New("upload does not exist")
+	}
+	if offset != u.Offset {
+		return http.StatusConflict, fmt.Errorf("upload is at offset %d, got %d", u.Offset, offset)
+	}
+	if r.ContentLength > u.FileSize-u.Offset {
+		return http.StatusRequestEntityTooLarge, errors.New("content exceeds the upload length")
+	}
+
+	if u.Offset < u.FileSize {
+		n, err := appendUpload(u, r.Body)
+		if n > 0 {
+			u.Offset += n
+			u.Expire = time.Now().UTC().Add(tempExpiry)
+			if e := s.saveUpload(u); e != nil {
+				return http.StatusInternalServerError, e
+			}
+		}
+		if err != nil {
+			return http.StatusBadRequest, fmt.Errorf("upload %s is interrupted at offset %d: %w", id, u.Offset, err)
+		}
+	}
+	if u.Offset == u.FileSize {
+		if err := s.finishUpload(r.Context(), u); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Expires", u.Expire.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+	return 0, nil
+}
+
+// appendUpload appends the given content to the staging file of an
+// upload, and returns the number of bytes that are persisted.
+func appendUpload(u *upload, content io.Reader) (int64, error) {
+	p := uploadPath(u.Id)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// Drop whatever was written but not recorded.
+	if err := f.Truncate(u.Offset); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(u.Offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, io.LimitReader(content, u.FileSize-u.Offset))
+	if e := f.Sync(); e != nil {
+		return 0, e
+	}
+	return n, err
+}
+
+// finishUpload stores the complete content of an upload and commits it
+// as a file. The upload stays if storing fails, and finishes when the
+// client retries.
+func (s *Server) finishUpload(ctx context.Context, u *upload) (err error) {
+	f, err := os.Open(uploadPath(u.Id))
+	if errors.Is(err, fs.ErrNotExist) && u.FileSize == 0 {
+		f, err = os.Open(os.DevNull)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The file may become a version of another file and take its id.
+	id := u.Id
+	m := &u.Metadata
+	m.Expire = time.Time{}
+	m.Key, err = allocKey(chacha20poly1305.KeySize)
+	if err != nil {
+		return err
+	}
+	if Conf.Chunking {
+		err = s.store.PutChunks(ctx, &m.Object, f, s.knownChunk)
+	} else {
+		err = s.store.Put(ctx, &m.Object, f)
+	}
+	if err != nil {
+		return fmt.Errorf("upload failed with error: %w", err)
+	}
+
+	m.CreatedAt = time.Now().UTC()
+	if err := s.commit(ctx, m); err != nil {
+		return err
+	}
+	return s.removeUpload(id)
+}
+
+// handleTusDelete terminates an upload.
+func (s *Server) handleTusDelete(w http.ResponseWriter, r *http.Request, id string) (int, error) {
+	if !s.lockUpload(id) {
+		return http.StatusLocked, errors.New("upload is in progress")
+	}
+	defer s.unlockUpload(id)
+
+	if u, err := s.loadUpload(id); err != nil {
+		return http.StatusInternalServerError, err
+	} else if u == nil {
+		return http.StatusNotFound, errors.New("upload does not exist")
+	}
+	if err := s.removeUpload(id); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return 0, nil
+}
+
+// parseTusMetadata parses the Upload-Metadata header, a comma separated
+// list of keys and base64 encoded values.
+func parseTusMetadata(h string) map[string]string {
+	meta := map[string]string{}
+	for _, kv := range strings.Split(h, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(kv), " ")
+		if k == "" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			continue
+		}
+		meta[k] = string(b)
+	}
+	return meta
+}
+
+// sweepUploads periodically removes expired uploads.
+func (s *Server) sweepUploads() {
+	go func() {
+		t := time.NewTicker(time.Hour)
+		for range t.C {
+			var ids []string
+			s.db.View(func(t *bbolt.Tx) error {
+				return t.Bucket([]byte(uploadBucket)).ForEach(func(k, v []byte) error {
+					u := &upload{}
+					if err := json.Unmarshal(v, u); err != nil || time.Since(u.Expire) > 0 {
+						ids = append(ids, string(k))
+					}
+					return nil
+				})
+			})
+			for _, id := range ids {
+				if !s.lockUpload(id) {
+					continue
+				}
+				if err := s.removeUpload(id); err != nil {
+					log.Printf("upload %s cannot be removed: %v\n", id, err)
+				} else {
+					log.Printf("upload %s was expired.\n", id)
+				}
+				s.unlockUpload(id)
+			}
+		}
+	}()
+}
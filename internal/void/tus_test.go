@@ -0,0 +1,151 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// tusRequest sends a tus request of the given method to the given path
+// behind the authentication, and returns the response.
+func tusRequest(s *Server, method, path string, body io.Reader, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, body)
+	r.Header.Set("Tus-Resumable", tusVersion)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+
+	var (
+		code int
+		err  error
+	)
+	id := strings.TrimPrefix(path, tusPath)
+	switch method {
+	case http.MethodPost:
+		code, err = s.handleTusCreate(w, r)
+	case http.MethodHead:
+		code, err = s.handleTusHead(w, r, id)
+	case http.MethodPatch:
+		code, err = s.handleTusPatch(w, r, id)
+	case http.MethodDelete:
+		code, err = s.handleTusDelete(w, r, id)
+	}
+	if err != nil {
+		w.Code = code
+	}
+	return w
+}
+
+// brokenReader reads n bytes of r and fails afterwards.
+type brokenReader struct {
+	r io.Reader
+	n int
+}
+
+func (br *brokenReader) Read(b []byte) (int, error) {
+	if br.n == 0 {
+		return 0, errors.New("connection reset")
+	}
+	if len(b) > br.n {
+		b = b[:br.n]
+	}
+	n, err := br.r.Read(b)
+	br.n -= n
+	return n, err
+}
+
+func TestTusResume(t *testing.T) {
+	data := make([]byte, 300<<10)
+	rand.Read(data)
+
+	tests := []struct {
+		name  string
+		parts []int // the bytes of each request, or negative for broken requests
+	}{
+		{"one request", []int{len(data)}},
+		{"parts", []int{1, 100 << 10, len(data) - 1 - 100<<10}},
+		{"interrupted", []int{-(50 << 10), -(70 << 10), len(data) - 120<<10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			w := tusRequest(s, http.MethodPost, tusPath, nil,
+				"Upload-Length", strconv.Itoa(len(data)),
+				"Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("a.bin")))
+			if w.Code != http.StatusCreated {
+				t.Fatalf("create responds %d", w.Code)
+			}
+			loc := w.Header().Get("Location")
+
+			offset := 0
+			for _, n := range tt.parts {
+				var body io.Reader = bytes.NewReader(data[offset:])
+				if n < 0 {
+					n = -n
+					body = &brokenReader{r: body, n: n}
+				} else {
+					body = bytes.NewReader(data[offset : offset+n])
+				}
+
+				// A request that is not at the offset of the upload
+				// is refused.
+				w = tusRequest(s, http.MethodPatch, loc, bytes.NewReader(data[:1]),
+					"Content-Type", "application/offset+octet-stream",
+					"Upload-Offset", strconv.Itoa(offset+1))
+				if w.Code != http.StatusConflict {
+					t.Fatalf("patch at a wrong offset responds %d", w.Code)
+				}
+
+				tusRequest(s, http.MethodPatch, loc, body,
+					"Content-Type", "application/offset+octet-stream",
+					"Upload-Offset", strconv.Itoa(offset))
+				offset += n
+				if offset == len(data) {
+					break
+				}
+
+				w = tusRequest(s, http.MethodHead, loc, nil)
+				if got := w.Header().Get("Upload-Offset"); got != strconv.Itoa(offset) {
+					t.Fatalf("upload is at offset %s, want %d", got, offset)
+				}
+			}
+
+			id := strings.TrimPrefix(loc, tusPath)
+			w, err := getFile(t, s, nil, "id="+id)
+			if err != nil || !bytes.Equal(w.Body.Bytes(), data) {
+				t.Fatalf("get of the upload responds %d bytes: %v", w.Body.Len(), err)
+			}
+			if m := metadata(t, s, nil, id); m.FileName != "a.bin" {
+				t.Fatalf("upload is named %q", m.FileName)
+			}
+			if w = tusRequest(s, http.MethodHead, loc, nil); w.Code != http.StatusNotFound {
+				t.Fatalf("head of a finished upload responds %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestTusEmpty(t *testing.T) {
+	s := newTestServer(t)
+	w := tusRequest(s, http.MethodPost, tusPath, nil, "Upload-Length", "0")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create responds %d", w.Code)
+	}
+	id := strings.TrimPrefix(w.Header().Get("Location"), tusPath)
+	w, err := getFile(t, s, nil, "id="+id)
+	if err != nil || w.Body.Len() != 0 {
+		t.Fatalf("get of the empty upload responds %d bytes: %v", w.Body.Len(), err)
+	}
+}
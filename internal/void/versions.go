@@ -0,0 +1,277 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// If versioning is enabled, a file that is uploaded to the path of an
+// existing file becomes a new version of it: it takes over the id, the
+// path, the tags and the attributes of the file, and the previous
+// version is kept in the version bucket. A version is keyed by the id
+// of its file and its number, and its record is the metadata of the
+// file at the time, thus each version keeps its own object and key.
+// Files whose names are sealed are not versioned, as their names are
+// not in the tree of folders.
+
+// versionKey returns the key of the given version of a file.
+func versionKey(id string, version int) []byte {
+	return []byte(fmt.Sprintf("%s\x00%010d", id, version))
+}
+
+// versionOf returns the version number of the given file. Files that
+// were never versioned are the first version.
+func versionOf(m *Metadata) int {
+	if m.Version == 0 {
+		return 1
+	}
+	return m.Version
+}
+
+// fileVersions returns the previous versions of the given file within
+// the transaction in ascending order of their numbers.
+func fileVersions(t *bbolt.Tx, id string) (versions []*Metadata, err error) {
+	prefix := []byte(id + "\x00")
+	c := t.Bucket([]byte(versionBucket)).Cursor()
+	for k, v := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, v = c.Next() {
+		m := &Metadata{}
+		if err := json.Unmarshal(v, m); err != nil {
+			return nil, fmt.Errorf("versions/%q: invalid record: %w", k, err)
+		}
+		versions = append(versions, m)
+	}
+	return versions, nil
+}
+
+// supersede makes the given new file the next version of the file at
+// its requested path within the transaction, if there is one, and keeps
+// the current version in the version bucket.
+func supersede(t *bbolt.Tx, m *Metadata) error {
+	if m.FileName == "" {
+		return nil
+	}
+	id, _ := lookupPath(t, requestedPath(m))
+	if id == "" || id == m.Id {
+		return nil
+	}
+
+	cur := &Metadata{}
+	if err := json.Unmarshal(t.Bucket([]byte(fileBucket)).Get([]byte(id)), cur); err != nil {
+		return fmt.Errorf("file %s is broken: %w", id, err)
+	}
+	versions, err := fileVersions(t, id)
+	if err != nil {
+		return err
+	}
+	cur.Version = versionOf(cur)
+	next := cur.Version + 1
+	if n := len(versions); n > 0 && versions[n-1].Version >= next {
+		next = versions[n-1].Version + 1
+	}
+	b, _ := json.Marshal(cur)
+	if err := t.Bucket([]byte(versionBucket)).Put(versionKey(id, cur.Version), b); err != nil {
+		return err
+	}
+
+	m.Id, m.Path, m.Version = cur.Id, cur.Path, next
+	m.Tags, _ = cleanTags(append(cur.Tags, m.Tags...))
+	attrs := map[string]string{}
+	for k, v := range cur.Attrs {
+		attrs[k] = v
+	}
+	for k, v := range m.Attrs {
+		attrs[k] = v
+	}
+	m.Attrs, _ = cleanAttrs(attrs)
+	return nil
+}
+
+// dropVersion removes the given version within the transaction. Its
+// object is queued in the reap bucket unless other files still share
+// it. It returns the ids of the queued objects.
+func dropVersion(t *bbolt.Tx, m *Metadata) (queued [][]byte, err error) {
+	if err := t.Bucket([]byte(versionBucket)).Delete(versionKey(m.Id, m.Version)); err != nil {
+		return nil, err
+	}
+	unused, err := releaseObject(t, m)
+	if err != nil || !unused {
+		return nil, err
+	}
+	return queueObject(t, []byte(fmt.Sprintf("%s@%d", m.Id, m.Version)), m.FileName, &m.Object)
+}
+
+// removeVersions removes all previous versions of the given file within
+// the transaction, and returns the ids of the queued objects.
+func removeVersions(t *bbolt.Tx, id string) (queued [][]byte, err error) {
+	versions, err := fileVersions(t, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		q, err := dropVersion(t, v)
+		if err != nil {
+			return nil, err
+		}
+		queued = append(queued, q...)
+	}
+	return queued, nil
+}
+
+// rollback makes the given version of a file the current version, and
+// keeps the current version in the version bucket. The path, the tags
+// and the attributes belong to the file and stay as they are.
+func (s *Server) rollback(id string, version int) (m *Metadata, err error) {
+	err = s.db.Update(func(t *bbolt.Tx) error {
+		files := t.Bucket([]byte(fileBucket))
+		versions := t.Bucket([]byte(versionBucket))
+
+		cur := &Metadata{}
+		if err := json.Unmarshal(files.Get([]byte(id)), cur); err != nil || cur.UploadId == "" {
+			return errors.New("id does not exist")
+		}
+		cur.Version = versionOf(cur)
+		if version == cur.Version {
+			m = cur
+			return nil
+		}
+		v := &Metadata{}
+		if err := json.Unmarshal(versions.Get(versionKey(id, version)), v); err != nil {
+			return fmt.Errorf("version %d does not exist", version)
+		}
+
+		if err := versions.Delete(versionKey(id, version)); err != nil {
+			return err
+		}
+		b, _ := json.Marshal(cur)
+		if err := versions.Put(versionKey(id, cur.Version), b); err != nil {
+			return err
+		}
+		m = &Metadata{}
+		*m = *cur
+		m.Object, m.FileSize, m.CreatedAt, m.E2E = v.Object, v.FileSize, v.CreatedAt, v.E2E
+		m.Version = version
+		b, _ = json.Marshal(m)
+		return files.Put([]byte(id), b)
+	})
+	return
+}
+
+// handleVersions responds all versions of the given file, the current
+// version first.
+func (s *Server) handleVersions(w http.ResponseWriter, r *http.Request, cur *Metadata) (err error) {
+	var versions []*Metadata
+	err = s.db.View(func(t *bbolt.Tx) (err error) {
+		versions, err = fileVersions(t, cur.Id)
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	cur.Version = versionOf(cur)
+	all := []*Metadata{s.nameView(r, cur.publicView())}
+	for i := len(versions) - 1; i >= 0; i-- {
+		all = append(all, s.nameView(r, versions[i].publicView()))
+	}
+	b, _ := json.Marshal(all)
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	return
+}
+
+// handleRollback rolls the given file back to the version in the
+// request, and responds the metadata of the file.
+func (s *Server) handleRollback(w http.ResponseWriter, r *http.Request, id string) (err error) {
+	version, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if err != nil || version <= 0 {
+		err = errors.New("missing version for the rollback")
+		return
+	}
+
+	var m *Metadata
+	m, err = s.rollback(id, version)
+	if err != nil {
+		return
+	}
+	b, _ := json.Marshal(s.nameView(r, m.publicView()))
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	return
+}
+
+// sweepVersions periodically removes the previous versions of files
+// that exceed the retention.
+func (s *Server) sweepVersions() {
+	if !Conf.Versioning || (Conf.VersionKeep == 0 && Conf.VersionDays == 0) {
+		return
+	}
+
+	go func() {
+		t := time.NewTicker(time.Hour)
+		for range t.C {
+			s.expireVersions(context.Background())
+		}
+	}()
+}
+
+// expireVersions removes the previous versions of files beyond the
+// newest VersionKeep versions of each file, and those that are older
+// than VersionDays days.
+func (s *Server) expireVersions(ctx context.Context) {
+	var queued [][]byte
+	s.db.Update(func(t *bbolt.Tx) error {
+		var (
+			expired []*Metadata
+			group   []*Metadata // the versions of a file in ascending order
+		)
+		sweep := func() {
+			for i, v := range group {
+				tooMany := Conf.VersionKeep > 0 && len(group)-i > Conf.VersionKeep
+				tooOld := Conf.VersionDays > 0 && time.Since(v.CreatedAt) > time.Duration(Conf.VersionDays)*24*time.Hour
+				if tooMany || tooOld {
+					expired = append(expired, v)
+				}
+			}
+			group = nil
+		}
+		t.Bucket([]byte(versionBucket)).ForEach(func(k, v []byte) error {
+			m := &Metadata{}
+			if err := json.Unmarshal(v, m); err != nil {
+				return nil // reported by fsck
+			}
+			if len(group) > 0 && group[0].Id != m.Id {
+				sweep()
+			}
+			group = append(group, m)
+			return nil
+		})
+		sweep()
+
+		for _, v := range expired {
+			q, err := dropVersion(t, v)
+			if err != nil {
+				log.Printf("version %d of %s cannot be removed: %v\n", v.Version, v.Id, err)
+				continue
+			}
+			queued = append(queued, q...)
+			log.Printf("version %d of %s was expired.\n", v.Version, v.Id)
+		}
+		return nil
+	})
+	for _, id := range queued {
+		s.reap(ctx, id)
+	}
+}
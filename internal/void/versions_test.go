@@ -0,0 +1,156 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package void
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// versionNumbers returns the numbers of the previous versions of the
+// given file.
+func versionNumbers(t *testing.T, s *Server, id string) (numbers []int) {
+	t.Helper()
+	s.db.View(func(tx *bbolt.Tx) error {
+		versions, err := fileVersions(tx, id)
+		if err != nil {
+			t.Fatalf("versions: %v", err)
+		}
+		for _, v := range versions {
+			numbers = append(numbers, v.Version)
+		}
+		return nil
+	})
+	return numbers
+}
+
+// content returns the content of the given version of a file, or of
+// the current version if it is 0.
+func content(t *testing.T, s *Server, id string, version int) string {
+	t.Helper()
+	q := "id=" + id
+	if version > 0 {
+		q += "&version=" + strconv.Itoa(version)
+	}
+	w, err := getFile(t, s, nil, q)
+	if err != nil {
+		t.Fatalf("get %s: %v", q, err)
+	}
+	return w.Body.String()
+}
+
+func TestVersions(t *testing.T) {
+	s := newTestServer(t)
+	Conf.Versioning = true
+
+	// Uploads to the same path supersede the file and merge its tags.
+	id := postFile(t, s, "a.txt", []byte("one"), "tag", "draft")
+	for _, data := range []string{"two", "three"} {
+		if next := postFile(t, s, "a.txt", []byte(data), "tag", data); next != id {
+			t.Fatalf("upload to the same path is file %s, want a version of %s", next, id)
+		}
+	}
+	m := metadata(t, s, nil, id)
+	if m.Version != 3 || strings.Join(m.Tags, ",") != "draft,three,two" {
+		t.Fatalf("file is version %d, tags %v", m.Version, m.Tags)
+	}
+	for i, want := range []string{"one", "two"} {
+		if got := content(t, s, id, i+1); got != want {
+			t.Fatalf("version %d is %q, want %q", i+1, got, want)
+		}
+	}
+
+	// The rolled back version becomes current and keeps the others.
+	if _, err := s.rollback(id, 1); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	if got := content(t, s, id, 0); got != "one" {
+		t.Fatalf("rolled back file is %q", got)
+	}
+	if got := content(t, s, id, 3); got != "three" {
+		t.Fatalf("superseded version is %q", got)
+	}
+	if got := versionNumbers(t, s, id); len(got) != 2 || got[0] != 2 || got[1] != 3 {
+		t.Fatalf("versions are %v, want [2 3]", got)
+	}
+	if _, err := s.rollback(id, 4); err == nil {
+		t.Fatalf("rollback to a missing version succeeds")
+	}
+}
+
+func TestExpireVersions(t *testing.T) {
+	tests := []struct {
+		name     string
+		keep     int
+		days     int
+		versions []int // the remaining versions
+	}{
+		{"unlimited", 0, 0, []int{1, 2, 3}},
+		{"keep", 2, 0, []int{2, 3}},
+		{"days", 0, 7, []int{3}},
+		{"keep or days", 2, 7, []int{3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			Conf.Versioning, Conf.VersionKeep, Conf.VersionDays = true, tt.keep, tt.days
+			id := postFile(t, s, "a.txt", []byte("0"))
+			for i := 1; i <= 3; i++ {
+				postFile(t, s, "a.txt", []byte(strconv.Itoa(i)))
+			}
+
+			// The first two versions are older than a week.
+			var versions []*Metadata
+			s.db.View(func(tx *bbolt.Tx) (err error) {
+				versions, err = fileVersions(tx, id)
+				return
+			})
+			for _, v := range versions[:2] {
+				v.CreatedAt = time.Now().Add(-8 * 24 * time.Hour)
+				putRecord(s, versionBucket, string(versionKey(id, v.Version)), v)
+			}
+
+			s.expireVersions(context.Background())
+			got := versionNumbers(t, s, id)
+			if len(got) != len(tt.versions) {
+				t.Fatalf("versions are %v, want %v", got, tt.versions)
+			}
+			for i := range got {
+				if got[i] != tt.versions[i] {
+					t.Fatalf("versions are %v, want %v", got, tt.versions)
+				}
+			}
+
+			// The objects of expired versions are removed.
+			for _, v := range versions {
+				_, err := os.Stat(filepath.Join(Conf.StoreDirs[0], v.UploadId))
+				expired := !containsInt(tt.versions, v.Version)
+				if os.IsNotExist(err) != expired {
+					t.Fatalf("object of version %d is removed: %v, want %v", v.Version, os.IsNotExist(err), expired)
+				}
+			}
+			if got := content(t, s, id, 0); got != "3" {
+				t.Fatalf("current version is %q", got)
+			}
+		})
+	}
+}
+
+// containsInt reports whether the given numbers contain v.
+func containsInt(s []int, v int) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
@@ -10,6 +10,80 @@
 // - VOID_DB
 // - VOID_USER
 // - VOID_PASS
+//
+// Optionally, VOID_STORE selects the blob backends as a comma separated
+// list of "telegram" (default) and "local". The local backend stores
+// objects in the VOID_STORE_DIR directory and requires no Telegram bot.
+// Each file is replicated to every chat in the comma separated
+// VOID_TG_CHATID and every directory in the VOID_STORE_DIR path list,
+// unless VOID_ERASURE, eg. "4+2", spreads k data shards and m parity
+// shards of each file over them instead. If VOID_DEDUP is true, files
+// of the same content share a single object. If VOID_CDC is true, files
+// are uploaded in content defined chunks, and only chunks that are not
+// stored yet are uploaded. If VOID_COMPRESS is "gzip", the contents of
+// new files are compressed before they are encrypted.
+//
+// Files are organized in folders, "void up -dir" uploads into a folder,
+// and "void mkdir" and "void mv" create, move and rename folders and
+// files. Besides their ids, files are addressed by their paths, which
+// start with a slash, and are served at /void/fs/PATH.
+//
+// Files carry tags and KEY=VALUE attributes, which are set by "void up
+// -tag -attr" and edited by "void tag", "void untag" and "void attr",
+// and "void ls -tag" lists the files of tags. Tags are stored in
+// plaintext to index the files, and attributes are sealed together with
+// the names if VOID_SEAL_NAMES is true.
+//
+// The file list at /void is filtered by the name, the content type,
+// the size and the creation date, sorted and paginated by cursors.
+// "void ls" takes the same filters as flags.
+//
+// If VOID_VERSIONING is true, a file that is uploaded to the path of an
+// existing file becomes its new version, and the previous versions are
+// kept. "void versions" lists the versions of a file, "void down
+// -version" downloads one, and "void rollback" makes one current again.
+// VOID_VERSION_KEEP keeps only the number of previous versions, and
+// VOID_VERSION_DAYS only those of the last days, if they are positive.
+//
+// "void del" moves files to the trash, which "void trash ls" lists and
+// "void restore" restores them from. The server purges files from the
+// trash after VOID_TRASH_DAYS days, 30 by default, and removes their
+// contents from the backends. If it is 0, files are deleted right away.
+// Contents that a backend cannot delete are kept in it and reported by
+// the server log, which is the case for Telegram messages older than 48
+// hours, unless the bot is an administrator of a group or channel.
+//
+// The server scrubs all files daily to detect lost or corrupted objects,
+// VOID_SCRUB selects whether it reads random "sample" (default) ranges
+// or the "full" objects, or is "off". The results are reported by
+// /void?mode=scrub.
+//
+// Large files can be uploaded resumably by any tus 1.0 client at
+// /void/tus/, the content is staged next to VOID_DB until it is
+// complete. VOID_MAX_UPLOAD limits the bytes of an upload.
+//
+// If VOID_PROXY is true, the command line uploads and downloads files
+// through the server, and only needs VOID_USER and VOID_PASS. Otherwise
+// the command line accesses the backends directly, which requires the
+// keys of the files. The server hands them out only to the users in the
+// comma separated VOID_DIRECT_USERS.
+//
+// VOID_KEK, or the file in VOID_KEK_FILE, is a base64 encoded master key
+// that wraps the keys of files in VOID_DB. To rotate it, configure the
+// new master key and the previous one as VOID_KEK_OLD, then run
+// "void rewrap", which also wraps keys that were stored in plaintext.
+//
+// "void up -e2e" encrypts files before the upload by keys that never
+// leave the command line. The keys are derived from VOID_PASSPHRASE if
+// it is set, or kept in the local keyring file VOID_KEYRING otherwise,
+// and "void down" decrypts the files by the same means. The names of
+// these files are sealed by their keys as well.
+//
+// If VOID_SEAL_NAMES is true, the server seals the names and the
+// attributes of files by the master key. Only the users in the comma
+// separated VOID_META_USERS, or every user if it is empty, see them,
+// others see placeholders and no attributes in the listings. The sizes
+// are not sealed, as the backends reveal them anyway.
 package main
 
 import (
@@ -18,6 +92,9 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"changkun.de/x/void/internal/cmd"
 	"changkun.de/x/void/internal/void"
@@ -32,11 +109,25 @@ func main() {
 Open sourced at https://changkun.de/s/void.
 
 Command line usage:
-$ void up PATH [, PATH...]
-$ void down ID [, ID...]
-$ void del ID [, ID...]
-$ void ls
+$ void up [-e2e] [-dir DIR] [-tag TAG,...] [-attr KEY=VALUE...] PATH [, PATH...]
+$ void down [-version N] ID|PATH [, ID|PATH...]
+$ void del ID|PATH [, ID|PATH...]
+$ void trash ls
+$ void restore ID [, ID...]
+$ void ls [-tag TAG,...] [-q TEXT] [-name PATTERN] [-type TYPE]
+         [-min-size N] [-max-size N] [-after DATE] [-before DATE]
+         [-sort name|size|created_at] [-desc] [-limit N] [-cursor CURSOR] [DIR]
+$ void tag ID|PATH TAG [, TAG...]
+$ void untag ID|PATH TAG [, TAG...]
+$ void attr ID|PATH KEY=VALUE [, KEY=VALUE...]
+$ void versions ID|PATH [, ID|PATH...]
+$ void rollback ID|PATH VERSION
+$ void mkdir DIR [, DIR...]
+$ void mv SRC DST
 $ void serv
+$ void fsck [-repair]
+$ void rewrap
+$ void rekey ID [, ID...]
 `)
 		flag.PrintDefaults()
 	}
@@ -52,9 +143,18 @@ $ void serv
 
 	switch args[0] {
 	case "up", "upload":
-		for _, path := range args[1:] {
+		fset := flag.NewFlagSet("up", flag.ExitOnError)
+		e2e := fset.Bool("e2e", false, "encrypt the files by a key that never leaves this machine")
+		dir := fset.String("dir", "", "the folder of the files")
+		tags := fset.String("tag", "", "the comma separated tags of the files")
+		attrs := attrFlag{}
+		fset.Var(attrs, "attr", "an attribute KEY=VALUE of the files, may be repeated")
+		fset.Parse(args[1:])
+
+		opts := cmd.UploadOptions{E2E: *e2e, Dir: *dir, Tags: splitList(*tags), Attrs: attrs}
+		for _, path := range fset.Args() {
 			_, file := filepath.Split(path)
-			r, err := cmd.Upload(path)
+			r, err := cmd.Upload(path, opts)
 			if err != nil {
 				log.Printf("%s: %v\n", file, err)
 				return
@@ -62,8 +162,12 @@ $ void serv
 			log.Printf("%s: %s?id=%s\n", file, cmd.Endpoint, r.Id)
 		}
 	case "down", "download":
-		for _, id := range args[1:] {
-			err := cmd.Download(id)
+		fset := flag.NewFlagSet("down", flag.ExitOnError)
+		version := fset.Int("version", 0, "download the version of the files instead of the current one")
+		fset.Parse(args[1:])
+
+		for _, id := range fset.Args() {
+			err := cmd.Download(id, *version)
 			if err != nil {
 				log.Printf("%s: %v\n", id, err)
 			}
@@ -76,19 +180,209 @@ $ void serv
 			}
 			log.Printf("%s: DONE.\n", id)
 		}
+	case "trash":
+		if len(args) != 2 || args[1] != "ls" {
+			flag.CommandLine.Usage()
+			return
+		}
+		files, err := cmd.Trash()
+		if err != nil {
+			log.Printf("%v\n", err)
+			return
+		}
+		log.Println("Id\tFileName\tFileSize\tDeletedAt\tPath")
+		for _, f := range files {
+			deleted := "-"
+			if f.DeletedAt != nil {
+				deleted = f.DeletedAt.Format(time.RFC3339)
+			}
+			log.Printf("%s\t%s\t%d\t%s\t%s\n", f.Id, f.FileName, f.FileSize, deleted, f.Path)
+		}
+	case "restore":
+		for _, id := range args[1:] {
+			m, err := cmd.Restore(id)
+			if err != nil {
+				log.Printf("%s: %v\n", id, err)
+				continue
+			}
+			log.Printf("%s: restored to %s\n", id, m.Path)
+		}
 	case "ls", "list":
-		files, err := cmd.List()
+		fset := flag.NewFlagSet("ls", flag.ExitOnError)
+		var opts void.ListOptions
+		tags := fset.String("tag", "", "list only the files of all the comma separated tags")
+		fset.StringVar(&opts.Search, "q", "", "list only the files whose name contains the text")
+		fset.StringVar(&opts.Glob, "name", "", "list only the files whose name matches the pattern")
+		fset.StringVar(&opts.Type, "type", "", `list only the files of the content type, eg. "image/*"`)
+		fset.Int64Var(&opts.MinSize, "min-size", 0, "list only the files of at least the bytes")
+		fset.Int64Var(&opts.MaxSize, "max-size", 0, "list only the files of at most the bytes")
+		after := fset.String("after", "", "list only the files created at or after the date or time")
+		before := fset.String("before", "", "list only the files created before the date or time")
+		fset.StringVar(&opts.Sort, "sort", "", `sort the files by "name", "size" or "created_at" instead of ids`)
+		fset.BoolVar(&opts.Desc, "desc", false, "sort the files in descending order")
+		fset.IntVar(&opts.Limit, "limit", 0, "list only a page of the number of files")
+		fset.StringVar(&opts.Cursor, "cursor", "", "list the page after the cursor of the previous page")
+		fset.Parse(args[1:])
+
+		opts.Tags = splitList(*tags)
+		for _, t := range []struct {
+			flag, v string
+			t       *time.Time
+		}{{"after", *after, &opts.After}, {"before", *before, &opts.Before}} {
+			if t.v == "" {
+				continue
+			}
+			var err error
+			*t.t, err = void.ParseTime(t.v)
+			if err != nil {
+				log.Fatalf("-%s is neither a date nor a time of RFC 3339, got %s", t.flag, t.v)
+			}
+		}
+
+		if fset.NArg() > 0 {
+			folder, err := cmd.ListFolder(fset.Arg(0), opts)
+			if err != nil {
+				log.Printf("%v\n", err)
+				return
+			}
+			for _, name := range folder.Folders {
+				log.Printf("%s/\n", name)
+			}
+			for _, file := range folder.Files {
+				log.Println(file)
+			}
+			if folder.Next != "" {
+				log.Printf("more files follow, list them by -cursor %s\n", folder.Next)
+			}
+			return
+		}
+		files, next, err := cmd.List(opts)
 		if err != nil {
 			log.Printf("%v\n", err)
 		}
 
-		log.Println("Id\tFileName\tFileSize\tUploadId")
+		log.Println("Id\tFileName\tFileSize\tUploadId\tPath")
 		for _, file := range files {
 			log.Println(file)
 		}
+		if next != "" {
+			log.Printf("more files follow, list them by -cursor %s\n", next)
+		}
+	case "tag", "untag", "attr":
+		if len(args) < 3 {
+			flag.CommandLine.Usage()
+			return
+		}
+		p := &void.Patch{}
+		switch args[0] {
+		case "tag":
+			p.Tags = args[2:]
+		case "untag":
+			p.Untags = args[2:]
+		case "attr":
+			attrs := attrFlag{}
+			for _, kv := range args[2:] {
+				if err := attrs.Set(kv); err != nil {
+					log.Printf("%s: %v\n", args[1], err)
+					return
+				}
+			}
+			p.Attrs = attrs
+		}
+		m, err := cmd.Patch(args[1], p)
+		if err != nil {
+			log.Printf("%s: %v\n", args[1], err)
+			return
+		}
+		log.Printf("%s: tags %v, attributes %v\n", args[1], m.Tags, m.Attrs)
+	case "versions":
+		for _, id := range args[1:] {
+			versions, err := cmd.Versions(id)
+			if err != nil {
+				log.Printf("%s: %v\n", id, err)
+				continue
+			}
+			log.Printf("%s:\n", id)
+			log.Println("Version\tCreatedAt\tFileSize\tUploadId")
+			for _, v := range versions {
+				log.Printf("%d\t%s\t%d\t%s\n", v.Version, v.CreatedAt.Format(time.RFC3339), v.FileSize, v.UploadId)
+			}
+		}
+	case "rollback":
+		if len(args) != 3 {
+			flag.CommandLine.Usage()
+			return
+		}
+		version, err := strconv.Atoi(args[2])
+		if err != nil || version <= 0 {
+			log.Printf("%s: version is not a positive number, got %s\n", args[1], args[2])
+			return
+		}
+		m, err := cmd.Rollback(args[1], version)
+		if err != nil {
+			log.Printf("%s: %v\n", args[1], err)
+			return
+		}
+		log.Printf("%s: rolled back to version %d created at %s\n", args[1], m.Version, m.CreatedAt.Format(time.RFC3339))
+	case "mkdir":
+		for _, dir := range args[1:] {
+			if err := cmd.Mkdir(dir); err != nil {
+				log.Printf("%s: %v\n", dir, err)
+			}
+		}
+	case "mv", "move":
+		if len(args) != 3 {
+			flag.CommandLine.Usage()
+			return
+		}
+		if err := cmd.Move(args[1], args[2]); err != nil {
+			log.Printf("%s: %v\n", args[1], err)
+		}
 	case "serv", "serve":
 		void.NewServer().Run()
+	case "fsck":
+		fset := flag.NewFlagSet("fsck", flag.ExitOnError)
+		repair := fset.Bool("repair", false, "repair the found problems")
+		fset.Parse(args[1:])
+
+		n := void.Fsck(*repair)
+		switch {
+		case n == 0:
+			log.Println("no problem was found.")
+		case *repair:
+			log.Printf("%d problems were found and repaired.\n", n)
+		default:
+			log.Printf("%d problems were found, run with -repair to repair them.\n", n)
+		}
+	case "rekey":
+		n := void.Rekey(args[1:])
+		log.Printf("%d of %d files were rekeyed.\n", n, len(args[1:]))
+	case "rewrap":
+		n := void.Rewrap()
+		log.Printf("keys of %d records were rewrapped.\n", n)
 	default:
 		flag.CommandLine.Usage()
 	}
 }
+
+// attrFlag collects the attributes of repeated KEY=VALUE flags.
+type attrFlag map[string]string
+
+func (a attrFlag) String() string { return "" }
+
+func (a attrFlag) Set(kv string) error {
+	k, v, ok := strings.Cut(kv, "=")
+	if !ok {
+		return fmt.Errorf("%q is not of the form KEY=VALUE", kv)
+	}
+	a[k] = v
+	return nil
+}
+
+// splitList splits the given comma separated list.
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}